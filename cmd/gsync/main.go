@@ -0,0 +1,207 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command gsync creates and applies gsync patch files, or, like rdiff, signature and delta files.
+//
+//	gsync diff basis source patchfile
+//	gsync apply patchfile basis out
+//	gsync signature basis sigfile
+//	gsync delta sigfile source deltafile
+//	gsync patch basis deltafile out
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/c4milo/gsync"
+	"github.com/pkg/errors"
+)
+
+func main() {
+	var err error
+
+	switch {
+	case len(os.Args) == 5 && os.Args[1] == "diff":
+		err = diff(context.Background(), os.Args[2], os.Args[3], os.Args[4])
+	case len(os.Args) == 5 && os.Args[1] == "apply":
+		err = apply(context.Background(), os.Args[2], os.Args[3], os.Args[4])
+	case len(os.Args) == 4 && os.Args[1] == "signature":
+		err = signature(context.Background(), os.Args[2], os.Args[3])
+	case len(os.Args) == 5 && os.Args[1] == "delta":
+		err = delta(context.Background(), os.Args[2], os.Args[3], os.Args[4])
+	case len(os.Args) == 5 && os.Args[1] == "patch":
+		err = patch(context.Background(), os.Args[2], os.Args[3], os.Args[4])
+	default:
+		fmt.Fprintln(os.Stderr, "usage:\n  gsync diff basis source patchfile\n  gsync apply patchfile basis out\n"+
+			"  gsync signature basis sigfile\n  gsync delta sigfile source deltafile\n  gsync patch basis deltafile out")
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gsync:", err)
+		os.Exit(1)
+	}
+}
+
+// diff writes the patch file reconstructing source from basis.
+func diff(ctx context.Context, basis, source, patch string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b, err := os.Open(basis)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	fi, err := b.Stat()
+	if err != nil {
+		return err
+	}
+
+	s, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	sigs, err := gsync.Signatures(ctx, b, nil, gsync.WithBlockSize(gsync.BlockSizeFor(fi.Size())))
+	if err != nil {
+		return err
+	}
+
+	remote, err := gsync.LookUpTable(ctx, sigs)
+	if err != nil {
+		return err
+	}
+
+	ops, err := gsync.Sync(ctx, s, nil, remote)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(patch, func(f *os.File) error {
+		return gsync.WritePatch(ctx, f, fi.Size(), ops, gsync.WithBlockSize(gsync.BlockSizeFor(fi.Size())))
+	})
+}
+
+// apply reconstructs out from basis and the patch file.
+func apply(ctx context.Context, patch, basis, out string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p, err := os.Open(patch)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	fi, err := p.Stat()
+	if err != nil {
+		return err
+	}
+
+	pf, err := gsync.OpenPatchFile(p, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	b, err := os.Open(basis)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	return writeFile(out, func(f *os.File) error {
+		return gsync.Apply(ctx, f, b, pf.Operations(ctx), gsync.WithBlockSize(pf.BlockSize()))
+	})
+}
+
+// signature writes the signature file of basis.
+func signature(ctx context.Context, basis, sig string) error {
+	b, err := os.Open(basis)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	fi, err := b.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(sig, func(f *os.File) error {
+		return gsync.WriteSignature(ctx, b, nil, f, gsync.WithBlockSize(gsync.BlockSizeFor(fi.Size())))
+	})
+}
+
+// delta writes the delta file turning the file sig is the signature file of into source, gzip compressing
+// its literal data.
+func delta(ctx context.Context, sig, source, delta string) error {
+	g, err := os.Open(sig)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	s, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return writeFile(delta, func(f *os.File) error {
+		return gsync.WriteDelta(ctx, s, nil, g, f, gsync.WithCompression(gsync.GzipCompressor(gzip.DefaultCompression)))
+	})
+}
+
+// patch reconstructs out from basis and the delta file.
+func patch(ctx context.Context, basis, delta, out string) error {
+	b, err := os.Open(basis)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	d, err := os.Open(delta)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return writeFile(out, func(f *os.File) error {
+		return gsync.ApplyDelta(ctx, b, d, f)
+	})
+}
+
+// writeFile writes name through a temporary file, renamed over name only once fn succeeds, so out may be
+// the basis itself.
+func writeFile(name string, fn func(*os.File) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".gsync")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	// Temporary files are only readable by their owner.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed closing %s", name)
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -3,15 +3,127 @@
 // file, You can obtain one at http://mozilla.org/MPL/2.0/.
 
 // Package gsync implements a rsync-based algorithm for sending delta updates to a remote server.
+//
+// Signatures and Sync each run on their own goroutine and hand their results over channels. Both stop
+// and close their channels as soon as their context is cancelled, so cancelling the context shared by
+// a whole sync is enough to release every goroutine involved. Consumers that stop reading early without
+// cancelling the producer's context must drain the channel, see Drain, or the producer leaks.
+//
+// The algorithm itself only needs readers and writers, so it builds for WebAssembly (GOOS=js GOARCH=wasm) and
+// can compute deltas of in-memory data in a browser. Helpers relying on OS specific features must be kept
+// behind build constraints so that stays true.
 package gsync
 
-import "sync"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math"
+	"math/bits"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 const (
 	// DefaultBlockSize is the default block size.
 	DefaultBlockSize = 6 * 1024 // 6kb
+	// MinBlockSize and MaxBlockSize bound the block sizes BlockSizeFor picks.
+	MinBlockSize = 700
+	MaxBlockSize = 128 * 1024 // 128kb
 )
 
+// BlockSizeFor returns a block size suited to a file of the given size, to be set with WithBlockSize. Like
+// rsync, it picks the square root of the size of the file, rounded to a multiple of 8 and kept within
+// MinBlockSize and MaxBlockSize, which balances the size of the signatures against the size of the delta.
+func BlockSizeFor(size int64) int {
+	switch {
+	case size <= MinBlockSize*MinBlockSize:
+		return MinBlockSize
+	case size >= MaxBlockSize*MaxBlockSize:
+		return MaxBlockSize
+	}
+
+	// Corrects the floating point square root, which may be off by one.
+	n := int64(math.Sqrt(float64(size)))
+	for n*n > size {
+		n--
+	}
+	for (n+1)*(n+1) <= size {
+		n++
+	}
+
+	return int(n &^ 7)
+}
+
+// Workload describes what limits the throughput of a parallel stage of the sync process.
+type Workload int
+
+const (
+	// CPUBound workloads spend most of their time computing, as when blocks are hashed with a cryptographic
+	// strong hash, and scale with the number of CPUs.
+	CPUBound Workload = iota
+	// IOBound workloads spend most of their time waiting on reads or writes, as when blocks are hashed with
+	// a fast non-cryptographic hash, and extra workers only contend for the same reader or writer.
+	IOBound
+)
+
+// SuggestWorkers returns a reasonable number of workers for a parallel stage running the given workload.
+// CPU bound workloads get one worker per usable CPU, as reported by GOMAXPROCS. IO bound workloads get half
+// as many, since a couple of workers are usually enough to keep the storage busy. Unknown workloads are
+// taken as CPU bound. It never returns less than one. The heuristic is only a starting point, callers knowing
+// their data better should pick their own.
+func SuggestWorkers(w Workload) int {
+	n := runtime.GOMAXPROCS(0)
+	if w == IOBound {
+		n /= 2
+	}
+
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// ErrOutputTooLarge is returned by Apply when the reconstructed file would exceed the limit set with WithMaxOutputBytes.
+var ErrOutputTooLarge = errors.New("gsync: output too large")
+
+// ErrIncompleteDelta is returned by Apply when the operations end before the final one, or when they don't
+// reconstruct as many bytes as the final operation announces.
+var ErrIncompleteDelta = errors.New("gsync: incomplete delta")
+
+// ErrNoBasis is returned by Apply when an operation copies a block from the cached copy of the file, but there is none.
+var ErrNoBasis = errors.New("gsync: no cached copy of the file to copy blocks from")
+
+// ErrInvalidDelta is returned by ValidateDelta when operations are malformed or reference blocks the basis does not have.
+var ErrInvalidDelta = errors.New("gsync: invalid delta")
+
+// ErrTimeout is returned, or reported through the channels, when a call runs for longer than the timeout set
+// with WithTimeout. It wraps context.DeadlineExceeded, yet lets callers tell it apart from the cancellation of
+// their own context.
+var ErrTimeout error = timeoutError{}
+
+// timeoutError is the type of ErrTimeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "gsync: timeout" }
+
+// Unwrap returns context.DeadlineExceeded, for errors.Is.
+func (timeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// Timeout reports true, like the errors of net and os do for timeouts.
+func (timeoutError) Timeout() bool { return true }
+
+// ErrVerificationFailed is returned by ApplyVerify when the reconstructed file does not have the expected digest.
+var ErrVerificationFailed = errors.New("gsync: verification failed")
+
+// ErrBlockSizeMismatch is returned when signatures, or the options of a call, disagree on the block size.
+var ErrBlockSizeMismatch = errors.New("gsync: block size mismatch")
+
 // Rolling checksum is up to 16 bit length for simplicity and speed.
 const (
 	mod = 1 << 16
@@ -33,6 +145,35 @@ func rollingHash(block []byte) (uint32, uint32, uint32) {
 	return r1, r2, r
 }
 
+// keyedRollingHash works like rollingHash, summing the values table maps the bytes of the block to, instead of
+// the bytes themselves. Keying the table keeps the checksums of blocks from being known ahead of time.
+func keyedRollingHash(table *[256]uint32, block []byte) (uint32, uint32, uint32) {
+	var a, b uint32
+	l := uint32(len(block))
+	for index, value := range block {
+		a += table[value]
+		b += (l - uint32(index)) * table[value]
+	}
+	r1 := a % mod
+	r2 := b % mod
+	r := r1 + (mod * r2)
+
+	return r1, r2, r
+}
+
+// newWeakTable returns the table keyedRollingHash maps bytes with for key, made of 16 bits values derived from
+// it with SHA-256.
+func newWeakTable(key []byte) *[256]uint32 {
+	var table [256]uint32
+	for i := 0; i < len(table)/16; i++ {
+		sum := sha256.Sum256(append(append([]byte(nil), key...), byte(i)))
+		for j := 0; j < 16; j++ {
+			table[i*16+j] = uint32(binary.BigEndian.Uint16(sum[2*j:]))
+		}
+	}
+	return &table
+}
+
 // rollingHash2 incrementally calculates rolling checksum.
 func rollingHash2(l, r1, r2, outgoingValue, incomingValue uint32) (uint32, uint32, uint32) {
 	r1 = (r1 - outgoingValue + incomingValue) % mod
@@ -42,14 +183,66 @@ func rollingHash2(l, r1, r2, outgoingValue, incomingValue uint32) (uint32, uint3
 	return r1, r2, r
 }
 
+// rollingHashShrink calculates the rolling checksum of a block of length l without its first byte, outgoingValue.
+func rollingHashShrink(l, r1, r2, outgoingValue uint32) (uint32, uint32, uint32) {
+	r1 = (r1 - outgoingValue) % mod
+	r2 = (r2 - (l * outgoingValue)) % mod
+	r := r1 + (mod * r2)
+
+	return r1, r2, r
+}
+
+// strongSum calculates the strong checksum of a block. The key set with WithHashKey, then the big-endian block
+// index, when salted, are hashed ahead of the block data.
+func strongSum(shash hash.Hash, opt *options, index uint64, block []byte) []byte {
+	return appendStrongSum(nil, shash, opt, index, block)
+}
+
+// appendStrongSum appends the strong checksum of a block to dst, see strongSum.
+func appendStrongSum(dst []byte, shash hash.Hash, opt *options, index uint64, block []byte) []byte {
+	shash.Reset()
+	shash.Write(opt.hashKey)
+	if opt.indexSalt {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], index)
+		shash.Write(b[:])
+	}
+	shash.Write(block)
+	return shash.Sum(dst)
+}
+
+// strongSumsSlab is the number of strong checksums strongSums allocates room for at once.
+const strongSumsSlab = 256
+
+// strongSums carves the strong checksums of consecutive blocks out of shared arrays, sparing an allocation per
+// block. Checksums are capped to their length, so appending to one never overwrites the next.
+type strongSums struct {
+	buf []byte
+}
+
+// next returns the strong checksum of a block, see strongSum.
+func (s *strongSums) next(shash hash.Hash, opt *options, index uint64, block []byte) []byte {
+	if size := shash.Size(); cap(s.buf)-len(s.buf) < size {
+		s.buf = make([]byte, 0, strongSumsSlab*size)
+	}
+
+	n := len(s.buf)
+	s.buf = appendStrongSum(s.buf, shash, opt, index, block)
+	return s.buf[n:len(s.buf):len(s.buf)]
+}
+
 // BlockSignature contains file block index and checksums.
 type BlockSignature struct {
 	// Index is the block index
 	Index uint64
-	// Strong refers to the strong checksum, it need not to be cryptographic.
+	// Strong refers to the strong checksum, it need not to be cryptographic. It belongs to the receiver of
+	// the signature, and is never reused, though strong checksums of consecutive blocks may share an array.
 	Strong []byte
 	// Weak refers to the fast rsync rolling checksum
 	Weak uint32
+	// BlockSize is the size of the blocks the file was split in, so Sync can't silently use a different one.
+	// Zero, as in signatures built by hand, means unknown.
+	BlockSize int
 	// Error is used to report the error reading the file or calculating checksums.
 	Error error
 }
@@ -63,13 +256,157 @@ type BlockOperation struct {
 	// the remote end proceeds to get the block data from its local
 	// copy instead.
 	Data []byte
+	// Compression identifies the Compressor Data was compressed with, see WithCompression. Zero means Data
+	// is sent as is.
+	Compression uint8
 	// Error is used to report any error while sending operations.
 	Error error
+	// Dictionary is the version of the pre-shared dictionary the block has to be copied from, instead
+	// of the remote copy of the file. Zero means the block is not a dictionary block.
+	Dictionary uint32
+	// Final marks the last operation of a delta. It carries neither data nor a block to copy, just the
+	// size of the reconstructed file in TotalSize, so the remote end can detect truncated deltas.
+	Final bool
+	// TotalSize is the size of the reconstructed file. It is only set in the final operation.
+	TotalSize int64
+	// Checksum is the SHA-256 checksum of the whole reconstructed file, or its HMAC-SHA256 with the key set with
+	// WithHashKey. It is only set in the final operation, and optional: Apply checks it when set, failing with
+	// ErrVerificationFailed on mismatch.
+	Checksum []byte
+
+	// buf is the pooled buffer holding Data, if Sync was told to reuse buffers.
+	buf *[]byte
 }
 
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		b := make([]byte, DefaultBlockSize)
-		return &b
-	},
+// Release gives the buffer holding the data of o back for reuse, once the consumer is done with it. It only does
+// something for operations sent by Sync when told to reuse buffers, see WithBufferReuse, and releasing is optional:
+// buffers not released are garbage collected as usual. Neither o nor any copy of it may be used afterwards. Apply
+// releases the operations it applies, so operations handed to it must not be released, nor used once applied.
+func (o BlockOperation) Release() {
+	if o.buf != nil {
+		releaseBuffer(o.buf)
+	}
+}
+
+// Dictionary is a set of frequently occurring blocks shared by both ends ahead of time. Matching source blocks
+// against it reduces transfers even when there is no previous copy of the file to sync against, as
+// in first-time syncs of structured data.
+type Dictionary struct {
+	// Version identifies the dictionary contents. Both ends must agree on it and it must not be zero.
+	Version uint32
+	// Signatures is the lookup table of the dictionary blocks, as built by LookUpTable. Sync requires it.
+	Signatures map[uint32][]BlockSignature
+	// Blocks holds the dictionary data, split in blocks of the block size of the sync. Apply requires it.
+	Blocks io.ReaderAt
+}
+
+// Stats reports how Sync or Apply went, or are going, see WithStats and WithProgress.
+type Stats struct {
+	// MatchedBlocks is the number of blocks copied from the cached copy of the file, or from the dictionary,
+	// instead of being sent as literal data.
+	MatchedBlocks int64
+	// LiteralBytes is the number of bytes sent, or received, as literal data.
+	LiteralBytes int64
+	// BytesRead is the number of bytes of the source Sync went through.
+	BytesRead int64
+	// BytesWritten is the number of bytes Apply wrote to its destination.
+	BytesWritten int64
+	// Elapsed is the time since the call started.
+	Elapsed time.Duration
+
+	// The following are only reported by Sync.
+
+	// WeakMatches is the number of source positions whose weak checksum matched some block.
+	WeakMatches int64
+	// StrongMatches is the number of weak matches confirmed by the strong checksum.
+	StrongMatches int64
+	// StrongOnly tells Sync switched to looking blocks up by strong checksum alone, see WithStrongFallback.
+	// WeakMatches and StrongMatches stop counting when it does.
+	StrongOnly bool
+}
+
+// Logger receives detailed debug output about the sync process, like every operation sent or applied.
+type Logger interface {
+	// Debugf logs a message formatted as fmt.Printf does.
+	Debugf(format string, args ...interface{})
+}
+
+// logOperation logs the kind, index and size of an operation.
+func logOperation(l Logger, stage string, o BlockOperation) {
+	switch {
+	case o.Error != nil:
+		l.Debugf("%s: error: %v", stage, o.Error)
+	case o.Final:
+		l.Debugf("%s: final, total size %d", stage, o.TotalSize)
+	case len(o.Data) > 0 && o.Compression != 0:
+		l.Debugf("%s: literal, %d bytes compressed with %d", stage, len(o.Data), o.Compression)
+	case len(o.Data) > 0:
+		l.Debugf("%s: literal, %d bytes", stage, len(o.Data))
+	case o.Dictionary != 0:
+		l.Debugf("%s: copy block %d from dictionary %d", stage, o.Index, o.Dictionary)
+	default:
+		l.Debugf("%s: copy block %d", stage, o.Index)
+	}
+}
+
+// Drain discards the operations left in ops until it is closed, letting its producer exit. It is meant for
+// consumers giving up on a delta whose producer's context they don't control.
+func Drain(ops <-chan BlockOperation) {
+	for range ops {
+	}
+}
+
+// bufferPools holds a *sync.Pool of buffers per size class. Sizes are rounded up to a power of two, since block
+// sizes vary from file to file, which bounds the number of pools no matter how many sizes are asked for.
+var bufferPools = struct {
+	sync.RWMutex
+	m map[int]*sync.Pool
+}{m: make(map[int]*sync.Pool)}
+
+// sizeClass returns the smallest power of two not below n.
+func sizeClass(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// bufferPool returns the pool of buffers of the size class c, creating it if create is set, or nil.
+func bufferPool(c int, create bool) *sync.Pool {
+	bufferPools.RLock()
+	p := bufferPools.m[c]
+	bufferPools.RUnlock()
+	if p != nil || !create {
+		return p
+	}
+
+	bufferPools.Lock()
+	defer bufferPools.Unlock()
+	if p = bufferPools.m[c]; p == nil {
+		p = &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, c)
+				return &b
+			},
+		}
+		bufferPools.m[c] = p
+	}
+	return p
+}
+
+// pooledBuffer returns a buffer of n bytes from the pool of its size class.
+func pooledBuffer(n int) *[]byte {
+	b := bufferPool(sizeClass(n), true).Get().(*[]byte)
+	*b = (*b)[:n]
+	return b
+}
+
+// releaseBuffer gives back a buffer returned by pooledBuffer to the pool of its size class.
+func releaseBuffer(b *[]byte) {
+	if c := cap(*b); c == sizeClass(c) {
+		if p := bufferPool(c, false); p != nil {
+			*b = (*b)[:c]
+			p.Put(b)
+		}
+	}
 }
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BufferAllocator hands out the working buffers of Signatures, Sync and Apply, set with WithBufferAllocator.
+// It lets servers running many syncs at once account for, and cap, the memory all of them use.
+// Implementations must be safe for concurrent use.
+type BufferAllocator interface {
+	// Allocate returns a buffer of n bytes. It may block until enough memory is released, in which case it
+	// must return the context error once ctx is done.
+	Allocate(ctx context.Context, n int) ([]byte, error)
+	// Release gives back a buffer returned by Allocate, once it is not used anymore.
+	Release(buf []byte)
+}
+
+// LimitedAllocator is a BufferAllocator capping the total size of the buffers allocated and not released yet.
+// Allocations going over the limit block until enough buffers are released, so syncs slow down instead of
+// exhausting memory. A single allocation larger than the limit is only granted when no other buffer is in use.
+type LimitedAllocator struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	// released is closed, and replaced, every time a buffer is released.
+	released chan struct{}
+}
+
+// NewLimitedAllocator returns an allocator capping the buffers in use to limit bytes.
+func NewLimitedAllocator(limit int64) *LimitedAllocator {
+	return &LimitedAllocator{limit: limit, released: make(chan struct{})}
+}
+
+// Allocate implements BufferAllocator.
+func (a *LimitedAllocator) Allocate(ctx context.Context, n int) ([]byte, error) {
+	for {
+		a.mu.Lock()
+		if a.used == 0 || a.used+int64(n) <= a.limit {
+			a.used += int64(n)
+			a.mu.Unlock()
+			return make([]byte, n), nil
+		}
+		released := a.released
+		a.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release implements BufferAllocator.
+func (a *LimitedAllocator) Release(buf []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.used -= int64(len(buf))
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+// getBuffer returns a buffer of n bytes along with the function giving it back. Buffers come from the allocator
+// set with WithBufferAllocator, if any, or from the pool of buffers of their size otherwise.
+func getBuffer(ctx context.Context, opt *options, n int) ([]byte, func(), error) {
+	if a := opt.allocator; a != nil {
+		buf, err := a.Allocate(ctx, n)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed allocating buffer")
+		}
+		return buf[:n], func() { a.Release(buf) }, nil
+	}
+
+	bfp := pooledBuffer(n)
+	return *bfp, func() { releaseBuffer(bfp) }, nil
+}
+
+// bufferReads batches the reads Signatures issues to r in reads of the size set with WithReadSize. The returned
+// function releases the read buffer and must be called once done reading.
+func bufferReads(ctx context.Context, r io.Reader, opt *options) (io.Reader, func()) {
+	if opt.readSize <= opt.blockLen() {
+		return r, func() {}
+	}
+
+	if opt.allocator == nil {
+		return bufio.NewReaderSize(r, opt.readSize), func() {}
+	}
+
+	ar := &allocatedReader{ctx: ctx, r: r, opt: opt}
+	return ar, ar.release
+}
+
+// allocatedReader works like bufio.Reader, with a read buffer taken from the allocator the first time it is read.
+type allocatedReader struct {
+	ctx context.Context
+	r   io.Reader
+	opt *options
+
+	buf        []byte
+	free       func()
+	start, end int
+	err        error
+}
+
+// Read implements io.Reader.
+func (a *allocatedReader) Read(p []byte) (int, error) {
+	if a.buf == nil && a.err == nil {
+		a.buf, a.free, a.err = getBuffer(a.ctx, a.opt, a.opt.readSize)
+	}
+
+	if a.start == a.end {
+		if a.err != nil {
+			return 0, a.err
+		}
+
+		n, err := a.r.Read(a.buf)
+		a.start, a.end, a.err = 0, n, err
+		if n == 0 {
+			return 0, a.err
+		}
+	}
+
+	n := copy(p, a.buf[a.start:a.end])
+	a.start += n
+	return n, nil
+}
+
+// release gives back the read buffer, if it was ever allocated.
+func (a *allocatedReader) release() {
+	if a.free != nil {
+		a.free()
+		a.buf, a.free = nil, nil
+	}
+}
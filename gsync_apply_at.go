@@ -0,0 +1,442 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// ApplyAt works like Apply, writing every block at its offset within dst instead of writing them in sequence, and
+// truncating dst to the size of the reconstructed file, if dst can be truncated. With WithCheckpoint, it records
+// the number of operations applied and the offset they reached every n operations, and once more when done, so
+// an interrupted ApplyAt can be continued with ResumeApplyAt. Destinations implementing Sync are synced before
+// every checkpoint, so checkpoints never get ahead of the data.
+//
+// dst may be cache itself, to reconstruct a file in place, without a second copy of it. Blocks are then written
+// in an order that never overwrites cached blocks still to be copied, keeping the blocks that depend on each other
+// in memory, so ops are read in full before anything is written, including all their literal data. In place,
+// the size of cache must be known, from a Size or Stat method, and WithBlockTransform, WithTranscoder and
+// WithCheckpoint are not supported.
+//
+// Operations produce consecutive ranges of the reconstructed file, so no two of them overlap. Blocks are written
+// from the calling goroutine, one at a time, and all writes are done once ApplyAt returns.
+func ApplyAt(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	if dst == nil {
+		return errors.New("gsync: destination required")
+	}
+
+	opt := newOptions(opts)
+
+	tctx, cancel := opt.withTimeout(ctx)
+	defer cancel()
+
+	if sameFile(dst, cache) {
+		return timedOut(ctx, tctx, applyInPlace(tctx, dst, cache, ops, opt))
+	}
+	return timedOut(ctx, tctx, applyAt(tctx, dst, cache, ops, opt, &applyResume{}))
+}
+
+// ResumeApplyAt continues an ApplyAt interrupted after writing checkpoints with WithCheckpoint, given the same
+// delta again, as a restarted sync of the same files produces. It reads the last checkpoint from checkpoint,
+// and skips the operations applied before it, only reading the cached blocks they copy to verify the checksum
+// of the file. It fails with ErrInvalidDelta if the delta does not reach the offset the checkpoint recorded.
+// Resuming does not work in place, nor with WithTranscoder.
+func ResumeApplyAt(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, checkpoint io.Reader, ops <-chan BlockOperation, opts ...Option) error {
+	if dst == nil {
+		return errors.New("gsync: destination required")
+	}
+
+	index, offset, err := readCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	opt := newOptions(opts)
+	if sameFile(dst, cache) || opt.encoder != nil {
+		return errors.New("gsync: cannot resume applying in place or with a transcoder")
+	}
+
+	tctx, cancel := opt.withTimeout(ctx)
+	defer cancel()
+
+	return timedOut(ctx, tctx, applyAt(tctx, dst, cache, ops, opt, &applyResume{skip: index, offset: offset}))
+}
+
+// applyResume holds the checkpointing state of ApplyAt.
+type applyResume struct {
+	// skip is the number of operations applied before the checkpoint resumed from, and offset where they reached.
+	skip   uint64
+	offset int64
+	// checkpoint receives a checkpoint every n operations, see WithCheckpoint.
+	checkpoint io.Writer
+	every      uint64
+	// dst is the destination, synced before every checkpoint.
+	dst io.WriterAt
+}
+
+// record writes a checkpoint once the data written so far, some of it buffered in batch, made it to disk.
+func (r *applyResume) record(batch *bufio.Writer, applied uint64, offset int64) error {
+	if batch != nil {
+		if err := batch.Flush(); err != nil {
+			return errors.Wrapf(err, "failed writing block to destination")
+		}
+	}
+
+	if err := syncDst(r.dst); err != nil {
+		return err
+	}
+	return writeCheckpointAt(r.checkpoint, applied, offset)
+}
+
+// applyAt holds the logic of ApplyAt and ResumeApplyAt, out of place.
+func applyAt(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, ops <-chan BlockOperation, opt *options, res *applyResume) error {
+	res.dst = dst
+	if opt.checkpoint != nil {
+		res.checkpoint, res.every = opt.checkpoint, opt.checkpointEvery
+	}
+
+	w := &offsetWriter{w: dst, off: res.offset}
+	if err := apply(ctx, w, cache, ops, opt, res); err != nil {
+		return err
+	}
+
+	if err := truncate(dst, w.off); err != nil {
+		return err
+	}
+	return syncDst(dst)
+}
+
+// offsetWriter writes to an io.WriterAt in sequence, from off onwards.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// truncate truncates dst to size, if it can be.
+func truncate(dst io.WriterAt, size int64) error {
+	if t, ok := dst.(interface {
+		Truncate(size int64) error
+	}); ok {
+		if err := t.Truncate(size); err != nil {
+			return errors.Wrapf(err, "failed truncating destination")
+		}
+	}
+	return nil
+}
+
+// syncDst commits the data written to dst to disk, if dst can be synced.
+func syncDst(dst io.WriterAt) error {
+	if s, ok := dst.(interface {
+		Sync() error
+	}); ok {
+		if err := s.Sync(); err != nil {
+			return errors.Wrapf(err, "failed syncing destination")
+		}
+	}
+	return nil
+}
+
+// sameFile tells whether dst and cache are the same file.
+func sameFile(dst io.WriterAt, cache io.ReaderAt) bool {
+	if cache == nil {
+		return false
+	}
+
+	if f, ok := dst.(*os.File); ok {
+		g, ok := cache.(*os.File)
+		if !ok || f == nil || g == nil {
+			return false
+		}
+		if f == g {
+			return true
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			return false
+		}
+		gi, err := g.Stat()
+		return err == nil && os.SameFile(fi, gi)
+	}
+
+	// Comparing values of uncomparable types would panic.
+	if !reflect.TypeOf(dst).Comparable() {
+		return false
+	}
+	return interface{}(dst) == interface{}(cache)
+}
+
+// placedOp is an operation of a delta applied in place, along with its offset within the reconstructed file.
+type placedOp struct {
+	out int64
+	// data is the literal data, or the block copied, once read. Blocks copied from the cache are read right
+	// before being written, unless other blocks depend on them.
+	data     []byte
+	index    uint64
+	length   int
+	fromBase bool
+}
+
+// applyInPlace holds the logic of ApplyAt when dst is cache. The delta is read in full first. Blocks copied from
+// the cache are written first, each only once no other block to be copied reads the data it overwrites, and
+// literal data last. Blocks depending on each other are read ahead of time to break the cycle.
+func applyInPlace(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, ops <-chan BlockOperation, opt *options) error {
+	if opt.transform != nil || opt.encoder != nil || opt.decoder != nil || opt.checkpoint != nil {
+		return errors.New("gsync: block transforms, transcoders and checkpoints are not supported in place")
+	}
+
+	cacheSize, err := readerSize(cache)
+	if err != nil {
+		return err
+	}
+
+	var (
+		placed []*placedOp
+		size   int64
+		final  *BlockOperation
+		stats  Stats
+		prog   = newProgress(opt)
+		bsize  = int64(opt.blockLen())
+	)
+
+	in := &opReader{ops: ops, plan: opt.accessPlan}
+	for final == nil {
+		o, ok, err := in.next(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrIncompleteDelta
+		}
+
+		if opt.logger != nil {
+			logOperation(opt.logger, "apply", o)
+		}
+
+		p := &placedOp{out: size, index: o.Index}
+		switch {
+		case o.Error != nil:
+			return errors.Wrapf(o.Error, "failed applying operation")
+		case o.Final:
+			if o.TotalSize != size {
+				return errors.Wrapf(ErrIncompleteDelta, "expected %d bytes, got %d", o.TotalSize, size)
+			}
+			final = &o
+			continue
+		case len(o.Data) > 0:
+			data, err := opt.literal(o, nil)
+			if err != nil {
+				return err
+			}
+			p.data = data
+			stats.LiteralBytes += int64(len(data))
+		case o.Dictionary != 0:
+			d := opt.dictionary
+			if d == nil || d.Version != o.Dictionary {
+				return errors.Errorf("gsync: dictionary version %d not available", o.Dictionary)
+			}
+			if d.Blocks == nil {
+				return errors.Errorf("gsync: dictionary version %d has no blocks", o.Dictionary)
+			}
+
+			// Dictionary blocks do not live in the file, they can be read right away.
+			p.data = make([]byte, bsize)
+			n, err := d.Blocks.ReadAt(p.data, int64(o.Index)*bsize)
+			if err != nil && err != io.EOF {
+				return errors.Wrapf(err, "failed reading dictionary block")
+			}
+			p.data = p.data[:n]
+			stats.MatchedBlocks++
+		default:
+			if o.Index >= uint64((cacheSize+bsize-1)/bsize) {
+				return errors.Wrapf(ErrInvalidDelta, "block %d past the end of the cached file", o.Index)
+			}
+			start := int64(o.Index) * bsize
+			p.length = int(bsize)
+			if start+bsize > cacheSize {
+				p.length = int(cacheSize - start)
+			}
+			p.fromBase = true
+			stats.MatchedBlocks++
+		}
+
+		if p.length == 0 {
+			p.length = len(p.data)
+		}
+		size += int64(p.length)
+
+		if opt.maxOutputBytes > 0 && size > opt.maxOutputBytes {
+			return ErrOutputTooLarge
+		}
+		placed = append(placed, p)
+	}
+
+	if err := copyInPlace(ctx, dst, cache, placed, bsize); err != nil {
+		return err
+	}
+
+	for _, p := range placed {
+		if p.data == nil {
+			continue
+		}
+		if _, err := dst.WriteAt(p.data, p.out); err != nil {
+			return errors.Wrapf(err, "failed writing block to destination")
+		}
+	}
+
+	if err := truncate(dst, size); err != nil {
+		return err
+	}
+
+	if len(final.Checksum) > 0 {
+		sum := opt.fileHash()
+		if _, err := io.Copy(sum, io.NewSectionReader(cache, 0, size)); err != nil {
+			return errors.Wrapf(err, "failed reading reconstructed file")
+		}
+		if !hmac.Equal(final.Checksum, sum.Sum(nil)) {
+			return errors.Wrapf(ErrVerificationFailed, "reconstructed file does not match its checksum")
+		}
+	}
+
+	if err := syncDst(dst); err != nil {
+		return err
+	}
+
+	stats.BytesWritten = size
+	prog.update(&stats, true)
+	if opt.stats != nil {
+		*opt.stats = stats
+	}
+	return nil
+}
+
+// copyInPlace copies the blocks of placed taken from the cache, which is also dst, so that none is overwritten
+// before all copies reading it are done. Blocks that do so in a cycle are read into memory instead, to be written
+// along with the literal data. Blocks already in place are left alone.
+func copyInPlace(ctx context.Context, dst io.WriterAt, cache io.ReaderAt, placed []*placedOp, bsize int64) error {
+	var copies []*placedOp
+	for _, p := range placed {
+		if p.fromBase && p.out != int64(p.index)*bsize {
+			copies = append(copies, p)
+		}
+	}
+
+	// readers holds the copies reading every block of the cache. A copy has to wait for all the copies reading the
+	// blocks it overwrites: after[i] holds the copies waiting for copy i, and waiting[i] the number copy i waits for.
+	readers := make(map[uint64][]int)
+	for i, p := range copies {
+		readers[p.index] = append(readers[p.index], i)
+	}
+
+	after := make([][]int, len(copies))
+	waiting := make([]int, len(copies))
+	for i, p := range copies {
+		first, last := uint64(p.out/bsize), uint64((p.out+int64(p.length)-1)/bsize)
+		for b := first; b <= last; b++ {
+			for _, j := range readers[b] {
+				if j != i {
+					after[j] = append(after[j], i)
+					waiting[i]++
+				}
+			}
+		}
+	}
+
+	var ready []int
+	for i := range copies {
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	done := make([]bool, len(copies))
+	finish := func(i int) {
+		done[i] = true
+		for _, j := range after[i] {
+			if waiting[j]--; waiting[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+
+	read := func(p *placedOp) ([]byte, error) {
+		b := make([]byte, p.length)
+		if _, err := cache.ReadAt(b, int64(p.index)*bsize); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "failed reading cached block")
+		}
+		return b, nil
+	}
+
+	for pending, next := len(copies), 0; pending > 0; {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "failed applying block operations")
+		default:
+		}
+
+		// Without copies ready, all the ones left wait for each other. Reading one of them right away unblocks the
+		// ones waiting for it.
+		if len(ready) == 0 {
+			for done[next] {
+				next++
+			}
+
+			data, err := read(copies[next])
+			if err != nil {
+				return err
+			}
+			copies[next].data = data
+			finish(next)
+			pending--
+			continue
+		}
+
+		// Copies read ahead of time may get ready later on, they are written along with the literal data.
+		i := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		if done[i] {
+			continue
+		}
+
+		data, err := read(copies[i])
+		if err != nil {
+			return err
+		}
+		if _, err := dst.WriteAt(data, copies[i].out); err != nil {
+			return errors.Wrapf(err, "failed writing block to destination")
+		}
+		finish(i)
+		pending--
+	}
+	return nil
+}
+
+// readerSize returns the size of r, as reported by its Size or Stat method.
+func readerSize(r io.ReaderAt) (int64, error) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed reading cached file info")
+		}
+		return fi.Size(), nil
+	}
+	return 0, errors.New("gsync: size of the cached file unknown")
+}
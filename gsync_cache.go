@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureKey identifies the version of a file some signatures were calculated from.
+type SignatureKey struct {
+	// Path is the path of the file.
+	Path string
+	// Size is the size of the file when it was signed.
+	Size int64
+	// ModTime is the modification time of the file when it was signed.
+	ModTime time.Time
+}
+
+// SignatureCache stores block signatures of files so they don't have to be calculated again while files
+// remain unchanged. A file is considered changed when its size or modification time differs from the
+// ones it was signed with. Implementations must be safe for concurrent use and may keep signatures in
+// memory, on disk or in a database. A cache must only be used with a single strong hash and set of options,
+// since they are not part of the key.
+type SignatureCache interface {
+	// Get returns the signatures stored for key, reporting false if there are none, or if they
+	// belong to a different version of the file.
+	Get(key SignatureKey) ([]BlockSignature, bool)
+	// Put stores the signatures for key, replacing the ones stored for any other version of the file.
+	Put(key SignatureKey, sigs []BlockSignature)
+}
+
+// MemorySignatureCache is a SignatureCache keeping signatures in memory. The zero value is ready to use.
+type MemorySignatureCache struct {
+	mu      sync.RWMutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	key  SignatureKey
+	sigs []BlockSignature
+}
+
+// Get implements SignatureCache.
+func (c *MemorySignatureCache) Get(key SignatureKey) ([]BlockSignature, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e, ok := c.entries[key.Path]
+	if !ok || e.key.Size != key.Size || !e.key.ModTime.Equal(key.ModTime) {
+		return nil, false
+	}
+	return e.sigs, true
+}
+
+// Put implements SignatureCache.
+func (c *MemorySignatureCache) Put(key SignatureKey, sigs []BlockSignature) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]memoryCacheEntry)
+	}
+	c.entries[key.Path] = memoryCacheEntry{key: key, sigs: sigs}
+}
+
+// CachedSignatures returns the block signatures of the file at path, taking them from cache when
+// the file has not changed since they were stored, and calculating and storing them otherwise.
+// Signatures are only stored when the whole file could be read.
+func CachedSignatures(ctx context.Context, cache SignatureCache, path string, shash hash.Hash, opts ...Option) ([]BlockSignature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening file")
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading file info")
+	}
+
+	key := SignatureKey{Path: path, Size: fi.Size(), ModTime: fi.ModTime()}
+	return cachedSignatures(ctx, cache, key, f, shash, opts...)
+}
+
+// cachedSignatures works like CachedSignatures, with the signatures of the version of a file told by key, read
+// from r when not found in cache.
+func cachedSignatures(ctx context.Context, cache SignatureCache, key SignatureKey, r io.Reader, shash hash.Hash, opts ...Option) ([]BlockSignature, error) {
+	// Signatures calculated with another block size are of no use.
+	if sigs, ok := cache.Get(key); ok && (len(sigs) == 0 || sigs[0].BlockSize == newOptions(opts).blockLen()) {
+		return sigs, nil
+	}
+
+	var sigs []BlockSignature
+	err := SignaturesFunc(ctx, r, shash, func(s BlockSignature) error {
+		if s.Error != nil {
+			return s.Error
+		}
+		sigs = append(sigs, s)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.Put(key, sigs)
+	return sigs, nil
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// checkpointSize is the size of a checkpoint record: the big-endian index of the next block to sign,
+// followed by the big-endian offset of that block. ApplyAt records the number of operations applied instead,
+// followed by the offset they reached.
+const checkpointSize = 16
+
+// writeCheckpoint appends a checkpoint record for the given block index, of blocks of size bytes, to w.
+func writeCheckpoint(w io.Writer, index uint64, size int) error {
+	return writeCheckpointAt(w, index, int64(index*uint64(size)))
+}
+
+// writeCheckpointAt appends a checkpoint record for the given index and offset to w.
+func writeCheckpointAt(w io.Writer, index uint64, offset int64) error {
+	var record [checkpointSize]byte
+	binary.BigEndian.PutUint64(record[:8], index)
+	binary.BigEndian.PutUint64(record[8:], uint64(offset))
+
+	if _, err := w.Write(record[:]); err != nil {
+		return errors.Wrapf(err, "failed writing checkpoint")
+	}
+	return nil
+}
+
+// readCheckpoint returns the block index and offset recorded by the last complete checkpoint record in r.
+// Both are zero if r holds no complete record. A truncated trailing record, as left by an interrupted
+// write, is ignored.
+func readCheckpoint(r io.Reader) (uint64, int64, error) {
+	var (
+		index  uint64
+		offset int64
+		record [checkpointSize]byte
+	)
+
+	for {
+		_, err := io.ReadFull(r, record[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return index, offset, nil
+		}
+
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "failed reading checkpoint")
+		}
+
+		index = binary.BigEndian.Uint64(record[:8])
+		offset = int64(binary.BigEndian.Uint64(record[8:]))
+	}
+}
+
+// ResumeSignatures continues a scan interrupted after writing checkpoints with WithCheckpoint. It reads the last
+// checkpoint from checkpoint and works like Signatures from the block it points to, assigning it the right index.
+// Blocks signed before the checkpoint are not signed again, so their signatures must have been persisted.
+// Options are passed along to Signatures, so WithCheckpoint can be used again to keep recording the position.
+func ResumeSignatures(ctx context.Context, r io.ReaderAt, shash hash.Hash, checkpoint io.Reader, opts ...Option) (<-chan BlockSignature, error) {
+	if r == nil {
+		return nil, errors.New("gsync: reader required")
+	}
+
+	index, offset, err := readCheckpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithStartIndex(index, offset))
+	return Signatures(ctx, io.NewSectionReader(r, offset, math.MaxInt64-offset), shash, opts...)
+}
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"fmt"
 	"hash"
 	"io"
 
@@ -16,202 +15,637 @@ import (
 )
 
 // LookUpTable reads up blocks signatures and builds a lookup table for the client to search from when trying to decide
-// wether to send or not a block of data.
-func LookUpTable(ctx context.Context, bc <-chan BlockSignature) (map[uint32][]BlockSignature, error) {
+// wether to send or not a block of data. Signatures reporting errors are skipped and logged to the logger set with
+// WithLogger, if any, as are the number of signatures dropped because of WithMaxBucketDepth.
+func LookUpTable(ctx context.Context, bc <-chan BlockSignature, opts ...Option) (map[uint32][]BlockSignature, error) {
 	table := make(map[uint32][]BlockSignature)
+	err := loadTable(ctx, table, bc, newOptions(opts))
+	return table, err
+}
+
+// loadTable adds the block signatures read from bc to table.
+func loadTable(ctx context.Context, table map[uint32][]BlockSignature, bc <-chan BlockSignature, opt *options) error {
+	var (
+		dropped uint64
+		size    = tableBlockSize(table)
+		err     error
+	)
+
 	for c := range bc {
 		select {
 		case <-ctx.Done():
-			return table, errors.Wrapf(ctx.Err(), "failed building lookup table")
+			return errors.Wrapf(ctx.Err(), "failed building lookup table")
 		default:
 			break
 		}
 
 		if c.Error != nil {
-			fmt.Printf("gsync: checksum error: %#v\n", c.Error)
+			if opt.logger != nil {
+				opt.logger.Debugf("gsync: checksum error in block %d: %v", c.Index, c.Error)
+			}
+			continue
+		}
+
+		// Keeps reading, so the producer is not left blocked, but loads nothing after a mismatch.
+		if size == 0 {
+			size = c.BlockSize
+		}
+		if err == nil && c.BlockSize != 0 && c.BlockSize != size {
+			err = errors.Wrapf(ErrBlockSizeMismatch, "signature of block %d has blocks of %d bytes, others %d", c.Index, c.BlockSize, size)
+		}
+		if err != nil {
+			continue
+		}
+
+		if opt.maxBucketDepth > 0 && len(table[c.Weak]) >= opt.maxBucketDepth {
+			dropped++
 			continue
 		}
 		table[c.Weak] = append(table[c.Weak], c)
 	}
 
-	return table, nil
+	if dropped > 0 && opt.logger != nil {
+		opt.logger.Debugf("gsync: dropped %d signatures from full lookup table buckets", dropped)
+	}
+
+	return err
+}
+
+// tableBlockSize returns the block size recorded by the signatures in table, or zero if none does.
+func tableBlockSize(table map[uint32][]BlockSignature) int {
+	for _, bs := range table {
+		for _, b := range bs {
+			if b.BlockSize != 0 {
+				return b.BlockSize
+			}
+		}
+	}
+	return 0
+}
+
+// CompatibleWith tells whether Sync can sync against sigs with the given options, before it is run, failing with
+// ErrBlockSizeMismatch if signatures disagree on the block size, or if it differs from the one set with
+// WithBlockSize. Signatures reporting errors are skipped. Signatures do not record the strong hash they were
+// calculated with, which is left unchecked: a different one finds no matches.
+func CompatibleWith(sigs []BlockSignature, opts ...Option) error {
+	opt := newOptions(opts)
+
+	size := opt.blockSize
+	for _, s := range sigs {
+		if s.Error != nil || s.BlockSize == 0 {
+			continue
+		}
+		if size == 0 {
+			size = s.BlockSize
+		}
+		if s.BlockSize != size {
+			if size == opt.blockSize {
+				return errors.Wrapf(ErrBlockSizeMismatch, "signature of block %d has blocks of %d bytes, expected %d", s.Index, s.BlockSize, size)
+			}
+			return errors.Wrapf(ErrBlockSizeMismatch, "signature of block %d has blocks of %d bytes, others %d", s.Index, s.BlockSize, size)
+		}
+	}
+	return nil
+}
+
+// Syncer keeps the lookup table of remote block signatures around, so a server syncing many files can
+// reuse its memory instead of building a new table for every file. A Syncer is not safe for concurrent
+// use. It can be reused serially, as long as the operations channel returned by Sync has been drained
+// before calling Reset or LoadSignatures again.
+type Syncer struct {
+	shash hash.Hash
+	table map[uint32][]BlockSignature
+}
+
+// NewSyncer returns a Syncer with an empty lookup table, using shash as strong hash, or SHA-256 if shash is nil.
+func NewSyncer(shash hash.Hash) *Syncer {
+	if shash == nil {
+		shash = sha256.New()
+	}
+
+	return &Syncer{
+		shash: shash,
+		table: make(map[uint32][]BlockSignature),
+	}
+}
+
+// LoadSignatures adds the block signatures read from bc to the lookup table, as LookUpTable does.
+func (s *Syncer) LoadSignatures(ctx context.Context, bc <-chan BlockSignature, opts ...Option) error {
+	return loadTable(ctx, s.table, bc, newOptions(opts))
+}
+
+// Sync works like the package level Sync, using the signatures loaded so far.
+func (s *Syncer) Sync(ctx context.Context, r io.ReaderAt, opts ...Option) (<-chan BlockOperation, error) {
+	return Sync(ctx, r, s.shash, s.table, opts...)
+}
+
+// Reset empties the lookup table, keeping the memory it already allocated.
+func (s *Syncer) Reset() {
+	for k := range s.table {
+		delete(s.table, k)
+	}
 }
 
 // Sync sends tokens or literal bytes to the caller in order to efficiently re-construct a remote file. Whether to send
 // tokens or literals is determined by the remote checksums provided by the caller.
 // This function does not block and returns immediately. Also, the remote blocks map is accessed without a mutex,
-// so this function is expected to be called once the remote blocks map is fully populated.
+// so this function is expected to be called once the remote blocks map is fully populated. Sync stops sending
+// operations and closes the channel as soon as the context is cancelled.
 //
 // The caller must make sure the concrete reader instance is not nil or this function will panic.
-func Sync(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature) (<-chan BlockOperation, error) {
+//
+// The last operation sent is always marked as final, so the remote end can tell the whole delta was received.
+//
+// When the timeout set with WithTimeout runs out, Sync reports ErrTimeout as its last operation, unless
+// ctx is cancelled as well.
+//
+// Sync splits r in blocks of the size recorded by the remote signatures, see WithBlockSize.
+//
+// Blocks not found in remote are looked up in the dictionary set with WithDictionary, if any.
+func Sync(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) (<-chan BlockOperation, error) {
+	return startSync(ctx, r, shash, remote, opts, nil)
+}
+
+// startSync holds the logic of Sync, calling done, if not nil, right before closing the returned channel.
+func startSync(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, opts []Option, done func()) (<-chan BlockOperation, error) {
 	if r == nil {
 		return nil, errors.New("gsync: reader required")
 	}
 
-	o := make(chan BlockOperation)
+	opt := newOptions(opts)
+	if opt.dictionary != nil && opt.dictionary.Version == 0 {
+		return nil, errors.New("gsync: dictionary version required")
+	}
+
+	// Blocks must be as large as the remote ones, or nothing would match.
+	sizes := []int{tableBlockSize(remote)}
+	if opt.dictionary != nil {
+		sizes = append(sizes, tableBlockSize(opt.dictionary.Signatures))
+	}
+	for _, size := range sizes {
+		if size == 0 {
+			continue
+		}
+
+		if opt.blockSize == 0 {
+			opt.blockSize = size
+		}
+		if size != opt.blockSize {
+			return nil, errors.Wrapf(ErrBlockSizeMismatch, "signatures have blocks of %d bytes, expected %d", size, opt.blockSize)
+		}
+	}
+
+	o := make(chan BlockOperation, opt.channelBuffer)
 
 	if shash == nil {
 		shash = sha256.New()
 	}
 
-	go func() {
-		var (
-			r1, r2, rhash, old uint32
-			offset             int64
-			rolling, match     bool
-		)
+	if opt.decoder != nil {
+		r = &decodedReaderAt{r: r, dec: opt.decoder}
+	}
+
+	tctx, cancel := opt.withTimeout(ctx)
 
-		delta := make([]byte, 0)
+	go func() {
+		defer close(o)
+		defer cancel()
+		if done != nil {
+			defer done()
+		}
 
-		defer func() {
-			close(o)
-		}()
+		err := diff(tctx, r, shash, remote, opt, func(op BlockOperation) error {
+			if opt.logger != nil {
+				logOperation(opt.logger, "sync", op)
+			}
 
-		for {
-			// Allow for cancellation.
 			select {
+			case o <- op:
+				return nil
+			case <-tctx.Done():
+				return tctx.Err()
+			}
+		})
+		if err = timedOut(ctx, tctx, err); err != nil {
+			// Nobody may be listening anymore if the context was cancelled.
+			select {
+			case o <- BlockOperation{Error: err}:
 			case <-ctx.Done():
-				o <- BlockOperation{
-					Error: ctx.Err(),
-				}
-				return
-			default:
-				break
 			}
+		}
+	}()
 
-			bfp := bufferPool.Get().(*[]byte)
-			buffer := *bfp
+	return o, nil
+}
 
-			n, err := r.ReadAt(buffer, offset)
-			if err != nil && err != io.EOF {
-				o <- BlockOperation{
-					Error: errors.Wrapf(err, "failed reading data block"),
-				}
-				bufferPool.Put(bfp)
+// ReverseSync returns the operations reconstructing the older version of a file from its newer version. Storing the
+// newer version along with such a reverse delta is enough to recover the previous one, which is how backups keep
+// their history without storing every version in full. It is Sync with the roles swapped: newer is the basis
+// signatures are calculated from, and older the file to re-construct. Applying the operations requires newer as
+// cache.
+//
+// Unlike Sync, ReverseSync blocks until newer is fully read and its signatures are loaded.
+func ReverseSync(ctx context.Context, newer io.Reader, older io.ReaderAt, shash hash.Hash, opts ...Option) (<-chan BlockOperation, error) {
+	if newer == nil || older == nil {
+		return nil, errors.New("gsync: reader required")
+	}
 
-				// return since data corruption in the server is possible and a re-sync is required.
-				return
-			}
+	if shash == nil {
+		shash = sha256.New()
+	}
+
+	sigs, err := Signatures(ctx, newer, shash, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-			block := buffer[:n]
+	remote, err := LookUpTable(ctx, sigs, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-			// If there are no block signatures from remote server, send all data blocks
-			if len(remote) == 0 {
-				if n > 0 {
-					o <- BlockOperation{Data: block}
-					offset += int64(n)
-				}
+	return Sync(ctx, older, shash, remote, opts...)
+}
+
+// diff holds the core of Sync. It synchronously calls emit with every operation required to re-construct the source
+// file from the remote blocks, in order and final operation included, and stops at the first error returned by emit.
+// Data slices handed to emit are owned by the callee and are never reused by diff, unless given back with
+// BlockOperation.Release, see WithBufferReuse.
+func diff(ctx context.Context, r io.ReaderAt, shash hash.Hash, remote map[uint32][]BlockSignature, opt *options, emit func(BlockOperation) error) error {
+	var (
+		r1, r2, rhash, old uint32
+		offset             int64
+		rolling, match     bool
+		// size is the length of the last block looked up, which only shrinks near the end of the source.
+		size int
+	)
+
+	// delta collects the data of the source not found remotely, sent as it piles up, several blocks of it at a
+	// time, see literalLen. pending is the length of the data already sent since the last literal range reported.
+	var (
+		delta   = &literalBuffer{opt: opt}
+		pending int64
+	)
+
+	// The window slides over the source a byte at a time while there are no matches, reading it two blocks at
+	// a time instead of a block per byte.
+	buffer, release, err := getBuffer(ctx, opt, 2*opt.blockLen())
+	if err != nil {
+		return err
+	}
+	defer release()
+	win := &slidingWindow{r: r, buf: buffer}
+
+	// strong indexes blocks by strong checksum, once Sync falls back to strong checksums only.
+	var (
+		stats  Stats
+		strong *strongIndex
+		prog   = newProgress(opt)
+		// sum is the checksum of the whole file, fed with the data the operations sent so far reconstruct.
+		sum = opt.fileHash()
+	)
+
+	// finish hands stats over to the caller, if asked to, before sending the final operation, so the caller
+	// can read them as soon as the final operation is received.
+	finish := func(size int64) error {
+		stats.BytesRead = size
+		prog.update(&stats, true)
+		if opt.stats != nil {
+			*opt.stats = stats
+		}
+		return emit(BlockOperation{Final: true, TotalSize: size, Checksum: sum.Sum(nil)})
+	}
+
+	// literal reports a range of the source sent as literal data, if asked to.
+	literal := func(start, length int64) {
+		if opt.literalRanges != nil && length > 0 {
+			opt.literalRanges(start, length)
+		}
+	}
 
-				if err == io.EOF {
-					bufferPool.Put(bfp)
-					return
+	// flush sends the data collected in delta, if any, and reports the range it ends, if asked to.
+	flush := func(report bool) error {
+		n := int64(len(delta.data))
+		if report {
+			literal(offset-pending-n, pending+n)
+			pending = 0
+		} else {
+			pending += n
+		}
+
+		// If we don't guard against empty deltas, an operation with index 0 will be sent
+		// and the server will duplicate block 0 at the end of the reconstructed file.
+		if n == 0 {
+			return nil
+		}
+
+		sum.Write(delta.data)
+		op, err := delta.take()
+		if err != nil {
+			return err
+		}
+		if err := emit(op); err != nil {
+			return err
+		}
+		stats.LiteralBytes += n
+		return nil
+	}
+
+	for {
+		// Allow for cancellation.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			break
+		}
+
+		stats.BytesRead = offset
+		prog.update(&stats, false)
+
+		block, err := win.at(offset, opt.blockLen())
+		if err != nil && err != io.EOF {
+			// return since data corruption in the server is possible and a re-sync is required.
+			return errors.Wrapf(err, "failed reading data block")
+		}
+		n := len(block)
+
+		// If there are no block signatures from remote server, send all data blocks
+		if len(remote) == 0 && opt.dictionary == nil {
+			if n > 0 {
+				delta.write(block...)
+				offset += int64(n)
+			}
+			if delta.full(opt.blockLen()) || err == io.EOF {
+				if err := flush(false); err != nil {
+					return err
 				}
-				continue
 			}
 
-			if rolling {
-				new := uint32(block[n-1])
-				r1, r2, rhash = rollingHash2(uint32(n), r1, r2, old, new)
-			} else {
-				r1, r2, rhash = rollingHash(block)
+			if err == io.EOF {
+				literal(0, offset)
+				return finish(offset)
 			}
+			continue
+		}
 
-			if bs, ok := remote[rhash]; ok {
-				shash.Reset()
-				shash.Write(block)
-				s := shash.Sum(nil)
-
-				for _, b := range bs {
-					if !bytes.Equal(s, b.Strong) {
-						continue
-					}
+		// Once the window slid past the end of the source, the data not matched is sent.
+		if n == 0 {
+			if err := flush(true); err != nil {
+				return err
+			}
+			return finish(offset)
+		}
 
-					match = true
+		// Past the end of the source, the window only loses its first byte as it slides.
+		switch {
+		case rolling && n == size:
+			new := opt.weakValue(block[n-1])
+			r1, r2, rhash = rollingHash2(uint32(n), r1, r2, old, new)
+		case rolling && n == size-1:
+			r1, r2, rhash = rollingHashShrink(uint32(size), r1, r2, old)
+		default:
+			r1, r2, rhash = opt.weak(block)
+		}
+		size = n
 
-					// We need to send deltas before sending an index token.
-					if len(delta) > 0 {
-						send(ctx, bytes.NewReader(delta), o)
-						delta = make([]byte, 0)
-					}
+		var (
+			op BlockOperation
+			ok bool
+		)
+		if strong != nil {
+			op, ok = findStrong(shash, block, offset, strong, opt)
+		} else {
+			var weak bool
+			op, ok, weak = find(shash, block, rhash, offset, remote, opt)
+			if weak {
+				stats.WeakMatches++
+			}
+			if ok {
+				stats.StrongMatches++
+			}
 
-					// instructs the server to copy block data at offset b.Index
-					// from its own copy of the file.
-					o <- BlockOperation{Index: b.Index}
-					break
+			// Switches to strong checksums only once enough weak matches were seen to tell they are mostly false.
+			if opt.strongFallback > 0 && stats.WeakMatches >= strongFallbackSample &&
+				float64(stats.StrongMatches) < opt.strongFallback*float64(stats.WeakMatches) {
+				if opt.logger != nil {
+					opt.logger.Debugf("sync: %d of %d weak matches confirmed, switching to strong checksums only",
+						stats.StrongMatches, stats.WeakMatches)
 				}
+				strong = newStrongIndex(remote, opt)
+				stats.StrongOnly = true
 			}
+		}
 
-			if match {
-				if err == io.EOF {
-					bufferPool.Put(bfp)
-					break
-				}
+		if ok {
+			match = true
 
-				rolling, match = false, false
-				old, rhash, r1, r2 = 0, 0, 0, 0
-				offset += int64(n)
-			} else {
-				if err == io.EOF {
-					// If EOF is reached and not match data found, we add trailing data
-					// to delta array.
-					delta = append(delta, block...)
-					if len(delta) > 0 {
-						send(ctx, bytes.NewReader(delta), o)
-					}
-					bufferPool.Put(bfp)
-					break
-				}
-				rolling = true
-				old = uint32(block[0])
-				delta = append(delta, block[0])
-				offset++
+			// We need to send deltas before sending an index token.
+			if err := flush(true); err != nil {
+				return err
 			}
 
-			// Returning this buffer to the pool here gives us 5x more speed
-			bufferPool.Put(bfp)
+			// instructs the server to copy block data at offset op.Index
+			// from its own copy of the file, or from the dictionary.
+			sum.Write(block)
+			if err := emit(op); err != nil {
+				return err
+			}
+			stats.MatchedBlocks++
 		}
-	}()
 
-	return o, nil
-}
+		if match {
+			if err == io.EOF {
+				return finish(offset + int64(n))
+			}
 
-// send sends all deltas over the channel. Any error is reported back using the
-// same channel.
-func send(ctx context.Context, r io.Reader, o chan<- BlockOperation) {
-	for {
-		// Allow for cancellation.
-		select {
-		case <-ctx.Done():
-			o <- BlockOperation{
-				Error: ctx.Err(),
+			rolling, match = false, false
+			old, rhash, r1, r2 = 0, 0, 0, 0
+			offset += int64(n)
+		} else {
+			// Near the end of the source the window keeps sliding, shrinking, as the last block of the remote file
+			// may be shorter than the others.
+			rolling = true
+			old = opt.weakValue(block[0])
+			delta.write(block[0])
+			offset++
+
+			// Data not found remotely is sent as it piles up, as much of it as fits in a literal at a time.
+			if delta.full(1) {
+				if err := flush(false); err != nil {
+					return err
+				}
 			}
-			return
-		default:
-			// break out of the select block and continue reading
-			break
 		}
+	}
+}
 
-		bfp := bufferPool.Get().(*[]byte)
-		buffer := *bfp
-		defer bufferPool.Put(bfp)
+// slidingWindow reads blocks of a source at increasing offsets, buffering as much of it as fits in buf.
+type slidingWindow struct {
+	r   io.ReaderAt
+	buf []byte
+	// off is the offset of buf within the source, n the number of bytes buffered, err the error reading them.
+	off int64
+	n   int
+	err error
+}
 
-		n, err := r.Read(buffer)
+// at returns size bytes of the source at offset off, or as many as there are along with io.EOF. The returned slice
+// is only valid until the next call, and off must not be lower than in the previous call.
+func (w *slidingWindow) at(off int64, size int) ([]byte, error) {
+	if end := off + int64(size); off < w.off || (end > w.off+int64(w.n) && w.err == nil) {
+		n, err := w.r.ReadAt(w.buf, off)
 		if err != nil && err != io.EOF {
-			o <- BlockOperation{
-				Error: errors.Wrapf(err, "failed reading data block"),
+			return nil, err
+		}
+		w.off, w.n, w.err = off, n, err
+	}
+
+	start := int(off - w.off)
+	if start > w.n {
+		start = w.n
+	}
+
+	end := start + size
+	if end > w.n {
+		return w.buf[start:w.n], io.EOF
+	}
+	return w.buf[start:end], nil
+}
+
+// find looks for a block matching both checksums, first among the remote blocks and then in the dictionary, if any.
+// It returns the operation copying the matching block, the one with the lowest index if several match, and whether
+// any block matched the weak checksum. offset is the position of the block within the source, it only matters for
+// salted checksums.
+func find(shash hash.Hash, block []byte, weak uint32, offset int64, remote map[uint32][]BlockSignature, opt *options) (BlockOperation, bool, bool) {
+	var dbs []BlockSignature
+	if opt.dictionary != nil {
+		dbs = opt.dictionary.Signatures[weak]
+	}
+
+	bs := remote[weak]
+	if len(bs) == 0 && len(dbs) == 0 {
+		return BlockOperation{}, false, false
+	}
+
+	index := uint64(offset / int64(opt.blockLen()))
+	op, ok := confirm(strongSum(shash, opt, index, block), index, bs, dbs, opt)
+	return op, ok, true
+}
+
+// findStrong works like find, looking blocks up by their strong checksum alone, see WithStrongFallback.
+func findStrong(shash hash.Hash, block []byte, offset int64, strong *strongIndex, opt *options) (BlockOperation, bool) {
+	index := uint64(offset / int64(opt.blockLen()))
+	s := strongSum(shash, opt, index, block)
+	return confirm(s, index, strong.remote[string(s)], strong.dictionary[string(s)], opt)
+}
+
+// confirm returns the operation copying the block with strong checksum s among the remote blocks bs, or else
+// among the dictionary blocks dbs. index is the index of the block position within the source.
+func confirm(s []byte, index uint64, bs, dbs []BlockSignature, opt *options) (BlockOperation, bool) {
+	// Salted checksums are keyed on the index of the block position within the source, so only blocks at that
+	// same index can match.
+	match := func(b BlockSignature) bool {
+		return (!opt.indexSalt || b.Index == index) && bytes.Equal(s, b.Strong)
+	}
+
+	if index, ok := lowest(match, bs); ok {
+		return BlockOperation{Index: index}, true
+	}
+
+	if index, ok := lowest(match, dbs); ok {
+		return BlockOperation{Index: index, Dictionary: opt.dictionary.Version}, true
+	}
+
+	return BlockOperation{}, false
+}
+
+// strongIndex holds the remote and dictionary blocks keyed by strong checksum.
+type strongIndex struct {
+	remote     map[string][]BlockSignature
+	dictionary map[string][]BlockSignature
+}
+
+// newStrongIndex indexes the remote and dictionary blocks by strong checksum.
+func newStrongIndex(remote map[uint32][]BlockSignature, opt *options) *strongIndex {
+	index := func(table map[uint32][]BlockSignature) map[string][]BlockSignature {
+		m := make(map[string][]BlockSignature)
+		for _, bs := range table {
+			for _, b := range bs {
+				m[string(b.Strong)] = append(m[string(b.Strong)], b)
 			}
-			return
 		}
+		return m
+	}
 
-		// If we don't guard against 0 bytes reads, an operation with index 0 will be sent
-		// and the server will duplicate block 0 at the end of the reconstructed file.
-		if n > 0 {
-			block := buffer[:n]
-			o <- BlockOperation{Data: block}
+	strong := &strongIndex{remote: index(remote)}
+	if opt.dictionary != nil {
+		strong.dictionary = index(opt.dictionary.Signatures)
+	}
+	return strong
+}
+
+// lowest returns the lowest index among the matching blocks. Picking the lowest index, instead of the first found,
+// makes deltas reproducible regardless of the order signatures were loaded in.
+func lowest(match func(BlockSignature) bool, bs []BlockSignature) (uint64, bool) {
+	var (
+		index uint64
+		found bool
+	)
+
+	for _, b := range bs {
+		if (!found || b.Index < index) && match(b) {
+			index, found = b.Index, true
 		}
+	}
+	return index, found
+}
 
-		if err == io.EOF {
-			break
+// literalBuffer collects the data Sync sends as literals, up to opt.literalLen bytes, in a pooled buffer if asked
+// to reuse buffers.
+type literalBuffer struct {
+	opt  *options
+	data []byte
+	buf  *[]byte
+}
+
+// write appends p to the data collected.
+func (l *literalBuffer) write(p ...byte) {
+	if l.data == nil {
+		if l.opt.bufferReuse {
+			l.buf = pooledBuffer(l.opt.literalLen())
+			l.data = (*l.buf)[:0]
+		} else {
+			l.data = make([]byte, 0, l.opt.literalLen())
 		}
 	}
+	l.data = append(l.data, p...)
+}
+
+// full reports whether n more bytes would not fit in a single literal.
+func (l *literalBuffer) full(n int) bool {
+	return len(l.data)+n > l.opt.literalLen()
+}
+
+// take returns the operation sending the data collected, compressed if asked to, and empties the buffer. Data
+// sent as is is handed over, along with its buffer, the caller must not modify it afterwards.
+func (l *literalBuffer) take() (BlockOperation, error) {
+	op, err := l.opt.compress(l.data)
+	if err != nil {
+		return BlockOperation{}, errors.Wrapf(err, "failed compressing literal data")
+	}
+
+	switch {
+	case op.Compression != 0:
+		// Compressed data is a copy, the buffer can be kept.
+		l.data = l.data[:0]
+	case l.buf == nil && 2*len(l.data) < cap(l.data):
+		// Short literals are copied instead of holding on to a whole block, and the buffer is kept.
+		op.Data = append([]byte(nil), l.data...)
+		l.data = l.data[:0]
+	default:
+		op.buf = l.buf
+		l.data, l.buf = nil, nil
+	}
+	return op, nil
 }
@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// GzipCompression is the Compression of operations whose data was compressed by GzipCompressor.
+const GzipCompression uint8 = 1
+
+// Compressor compresses the data of literal operations, see WithCompression.
+type Compressor interface {
+	// ID identifies the compression format in BlockOperation.Compression. It must not be zero, and both ends
+	// must agree on it, as with dictionary versions. GzipCompression is taken by GzipCompressor.
+	ID() uint8
+	// Compress returns the compressed form of data, in a new slice.
+	Compress(data []byte) ([]byte, error)
+	// Decompress decompresses data into dst, returning the decompressed data. It fails if the decompressed
+	// data does not fit in dst.
+	Decompress(dst, data []byte) ([]byte, error)
+}
+
+// gzipCompressor is the Compressor returned by GzipCompressor. Writers and readers are expensive to allocate,
+// so they are pooled.
+type gzipCompressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// GzipCompressor returns a Compressor producing gzip streams with the given compression level.
+func GzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+// defaultGzip decompresses gzip compressed operations Apply is not given a Compressor for.
+var defaultGzip = GzipCompressor(gzip.DefaultCompression)
+
+// ID implements Compressor.
+func (c *gzipCompressor) ID() uint8 {
+	return GzipCompression
+}
+
+// Compress implements Compressor.
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(&buf)
+	} else {
+		var err error
+		if zw, err = gzip.NewWriterLevel(&buf, c.level); err != nil {
+			return nil, errors.Wrapf(err, "failed compressing data")
+		}
+	}
+	defer c.writers.Put(zw)
+
+	if _, err := zw.Write(data); err != nil {
+		return nil, errors.Wrapf(err, "failed compressing data")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrapf(err, "failed compressing data")
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor.
+func (c *gzipCompressor) Decompress(dst, data []byte) ([]byte, error) {
+	var err error
+
+	zr, ok := c.readers.Get().(*gzip.Reader)
+	if ok {
+		err = zr.Reset(bytes.NewReader(data))
+	} else {
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed decompressing data")
+	}
+	defer c.readers.Put(zr)
+
+	n, err := io.ReadFull(zr, dst)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return dst[:n], nil
+	case nil:
+		// dst is full, the stream has to end right there.
+		var b [1]byte
+		if _, err := zr.Read(b[:]); err != io.EOF {
+			return nil, errors.Errorf("gsync: decompressed data larger than %d bytes", len(dst))
+		}
+		return dst, nil
+	default:
+		return nil, errors.Wrapf(err, "failed decompressing data")
+	}
+}
+
+// compress returns the operation sending the literal data, compressed if a Compressor is set and compression
+// makes it smaller.
+func (o *options) compress(data []byte) (BlockOperation, error) {
+	if o.compressor == nil {
+		return BlockOperation{Data: data}, nil
+	}
+
+	c, err := o.compressor.Compress(data)
+	if err != nil {
+		return BlockOperation{}, err
+	}
+	if len(c) >= len(data) {
+		return BlockOperation{Data: data}, nil
+	}
+	return BlockOperation{Data: c, Compression: o.compressor.ID()}, nil
+}
+
+// literal returns the data of the literal operation op, decompressed if compressed into buf, or into a new buffer
+// if buf is nil. Compressed literals can't decompress to more than literalLen bytes, since Sync never sends
+// larger literals, so buf must be at least that large.
+func (o *options) literal(op BlockOperation, buf []byte) ([]byte, error) {
+	if op.Compression == 0 {
+		return op.Data, nil
+	}
+
+	c := o.compressor
+	if c == nil || c.ID() != op.Compression {
+		if op.Compression != GzipCompression {
+			return nil, errors.Errorf("gsync: compression %d not available", op.Compression)
+		}
+		c = defaultGzip
+	}
+
+	if buf == nil {
+		buf = make([]byte, o.literalLen())
+	}
+	data, err := c.Decompress(buf[:o.literalLen()], op.Data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed decompressing literal data")
+	}
+	return data, nil
+}
@@ -0,0 +1,740 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.16
+// +build go1.16
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WritableFS is a filesystem SyncDir can write to. Names are slash-separated paths, as in fs.FS.
+type WritableFS interface {
+	fs.FS
+	// WriteFile calls fn with a writer for the new content of the file called name, and replaces the file with
+	// it once fn returns without error. Replaced files keep their permissions, new files get the default ones.
+	// The file must be readable as it was until then, since SyncDir copies blocks from it while writing its new
+	// content.
+	WriteFile(name string, fn func(io.Writer) error) error
+	// MkdirAll creates the directory called name, along with any missing parents.
+	MkdirAll(name string, perm fs.FileMode) error
+	// RemoveAll removes the file or directory called name, along with all it holds.
+	RemoveAll(name string) error
+}
+
+// MetadataFS is a WritableFS able to set the metadata of its files, which SyncDir does with WithPreserveMetadata.
+type MetadataFS interface {
+	WritableFS
+	// Chmod sets the permissions of the file called name.
+	Chmod(name string, mode fs.FileMode) error
+	// Chtimes sets the access and modification times of the file called name.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// LinkFS is a WritableFS able to create hard links, which SyncDir does with WithDeduplicateIdentical.
+type LinkFS interface {
+	WritableFS
+	// Link makes the file called newname a hard link to the one called oldname, replacing it if it exists.
+	Link(oldname, newname string) error
+}
+
+// DirFS returns a MetadataFS for the directory tree rooted at dir, read as with os.DirFS, which is a LinkFS as
+// well. New file contents are written to temporary files first, renamed over the files they replace.
+func DirFS(dir string) MetadataFS {
+	return dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+// path returns the path on disk of the file called name.
+func (d dirFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+func (d dirFS) WriteFile(name string, fn func(io.Writer) error) error {
+	p, err := d.path("write", name)
+	if err != nil {
+		return err
+	}
+
+	f, err := createTemp(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	// Files replaced keep their permissions, as far as the filesystem can tell them.
+	if info, err := os.Stat(p); err == nil {
+		if err := f.Chmod(info.Mode().Perm()); err != nil && !unsupported(err) {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (d dirFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := d.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+func (d dirFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := d.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+func (d dirFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := d.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (d dirFS) RemoveAll(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (d dirFS) Link(oldname, newname string) error {
+	op, err := d.path("link", oldname)
+	if err != nil {
+		return err
+	}
+	np, err := d.path("link", newname)
+	if err != nil {
+		return err
+	}
+
+	// Links are made under a temporary name, renamed over the file they replace.
+	var tmp string
+	for i := 0; ; i++ {
+		tmp = tempName(filepath.Dir(np))
+		err := os.Link(op, tmp)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	if err := os.Rename(tmp, np); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// tempName returns a random name for a temporary file in dir.
+func tempName(dir string) string {
+	return filepath.Join(dir, ".gsync"+strconv.FormatUint(uint64(rand.Uint32()), 10))
+}
+
+// createTemp creates a new temporary file in dir, with the default permissions of new files, unlike
+// ioutil.TempFile, which makes them private.
+func createTemp(dir string) (*os.File, error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(tempName(dir), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// unsupported tells whether err reports metadata the filesystem can't represent, as permissions on FAT
+// filesystems or some network shares. Permission errors are not among them, the caller may well lack the right
+// to change metadata the filesystem supports.
+func unsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EINVAL)
+}
+
+// FileAction is what SyncDir did to a destination file.
+type FileAction int
+
+const (
+	// FileUnchanged files were left alone, as they did not change.
+	FileUnchanged FileAction = iota
+	// FileAdded files were missing from the destination, and were copied over in full.
+	FileAdded
+	// FileModified files were synced, copying the blocks they still share from the destination.
+	FileModified
+	// FileRemoved files and directories were missing from the source, and were removed, see WithDeleteExtraneous.
+	FileRemoved
+)
+
+func (a FileAction) String() string {
+	switch a {
+	case FileUnchanged:
+		return "unchanged"
+	case FileAdded:
+		return "added"
+	case FileModified:
+		return "modified"
+	case FileRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// FileResult reports what SyncDir did to a file or directory.
+type FileResult struct {
+	// Name is the slash-separated path of the file, relative to the root of both trees.
+	Name string
+	// Action is what was done to the file, or what failed to be done if Error is set.
+	Action FileAction
+	// Error is the error syncing the file, if any. SyncDir goes on with the other files.
+	Error error
+}
+
+// SyncDir makes the dst tree a copy of the src tree, running the block-level sync on the files that changed only,
+// and pipes out the result of every file on the returned channel, closing it once done or when the context is
+// cancelled. Files are told changed by their size and modification time, or by their content with
+// WithCompareContents: unless told to preserve metadata with WithPreserveMetadata, destination files are
+// modified when synced, and count as changed if not as recent as the source ones. Directories are created as
+// needed, but only reported when removed. WithDeduplicateIdentical syncs the content of identical source files
+// once. Entries other than regular files and directories, such as symbolic links, are skipped. WithExclude leaves
+// paths alone, and WithDeleteExtraneous removes the destination files missing from the source, before syncing the
+// others, unless the source tree could not be fully read.
+//
+// Files are synced one after the other, keeping at most three of them open at a time: the source file, the
+// destination one and its new content. Blocks are sized after every destination file with BlockSizeFor, unless
+// set with WithBlockSize. The other options are passed along to Signatures, Sync and Apply, for every file.
+func SyncDir(ctx context.Context, src fs.FS, dst WritableFS, opts ...Option) (<-chan FileResult, error) {
+	if src == nil || dst == nil {
+		return nil, errors.New("gsync: source and destination filesystems required")
+	}
+
+	opt := newOptions(opts)
+	for _, p := range opt.excludes {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid exclude pattern %q", p)
+		}
+	}
+
+	c := make(chan FileResult)
+
+	go func() {
+		defer close(c)
+
+		ds := &dirSync{ctx: ctx, src: src, dst: dst, opt: opt, opts: opts, results: c, synced: make(map[string]bool)}
+		ds.run()
+	}()
+
+	return c, nil
+}
+
+// dirSync holds the state of a SyncDir call.
+type dirSync struct {
+	ctx     context.Context
+	src     fs.FS
+	dst     WritableFS
+	opt     *options
+	opts    []Option
+	results chan<- FileResult
+	// duplicates maps the source files found identical to an earlier one to it, see WithDeduplicateIdentical.
+	duplicates map[string]duplicate
+	// synced holds the files synced without error.
+	synced map[string]bool
+}
+
+// duplicate is a source file identical to an earlier one, whose destination file is copied or linked from the
+// earlier one's once synced.
+type duplicate struct {
+	// primary is the name of the earlier file.
+	primary string
+	// linked tells whether both source files are hard links to the same file.
+	linked bool
+}
+
+// report sends r out, returning false if the context was cancelled.
+func (ds *dirSync) report(r FileResult) bool {
+	select {
+	case ds.results <- r:
+		return true
+	case <-ds.ctx.Done():
+		return false
+	}
+}
+
+// excluded tells whether the path name was excluded with WithExclude.
+func (ds *dirSync) excluded(name string) bool {
+	for _, p := range ds.opt.excludes {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (ds *dirSync) run() {
+	// The source tree is listed first, so extraneous destination files can be told apart.
+	type entry struct {
+		name string
+		dir  bool
+	}
+
+	var (
+		entries []entry
+		isDir   = make(map[string]bool)
+		failed  bool
+	)
+
+	err := fs.WalkDir(ds.src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			failed = true
+			ds.report(FileResult{Name: name, Error: errors.Wrapf(err, "failed reading source")})
+			return ds.ctx.Err()
+		}
+
+		if name != "." && ds.excluded(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() || d.Type().IsRegular() {
+			entries = append(entries, entry{name, d.IsDir()})
+			isDir[name] = d.IsDir()
+		}
+		return ds.ctx.Err()
+	})
+	if err != nil {
+		return
+	}
+
+	// Files missing from a source tree not fully read may well be there.
+	if ds.opt.deleteExtraneous && !failed && !ds.deleteExtraneous(isDir) {
+		return
+	}
+
+	if ds.opt.deduplicateIdentical {
+		var files []string
+		for _, e := range entries {
+			if !e.dir {
+				files = append(files, e.name)
+			}
+		}
+		if ds.duplicates = ds.findDuplicates(files); ds.ctx.Err() != nil {
+			return
+		}
+	}
+
+	for _, e := range entries {
+		if ds.ctx.Err() != nil {
+			return
+		}
+
+		// The root directory is created as well, so the destination tree needs not exist.
+		if e.dir {
+			info, err := fs.Stat(ds.src, e.name)
+			if err == nil {
+				perm := fs.ModePerm
+				if ds.opt.preserveMetadata {
+					perm = info.Mode().Perm()
+				}
+				err = ds.dst.MkdirAll(e.name, perm)
+			}
+			if err != nil && !ds.report(FileResult{Name: e.name, Error: errors.Wrapf(err, "failed creating directory")}) {
+				return
+			}
+			continue
+		}
+
+		var (
+			action FileAction
+			err    error
+		)
+		// Duplicates of files that failed to sync are synced on their own.
+		if d, ok := ds.duplicates[e.name]; ok && ds.synced[d.primary] {
+			action, err = ds.syncDuplicate(e.name, d)
+		} else {
+			action, err = ds.syncFile(e.name)
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "failed syncing %s", e.name)
+		} else {
+			ds.synced[e.name] = true
+		}
+		if !ds.report(FileResult{Name: e.name, Action: action, Error: err}) {
+			return
+		}
+	}
+}
+
+// deleteExtraneous removes the entries of the destination tree missing from the source tree, whose directories
+// are listed in isDir along with its regular files. It returns false if the context was cancelled.
+func (ds *dirSync) deleteExtraneous(isDir map[string]bool) bool {
+	var extraneous []string
+
+	err := fs.WalkDir(ds.dst, ".", func(name string, d fs.DirEntry, err error) error {
+		// There is nothing to remove from a destination tree yet to be created.
+		if name == "." && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			ds.report(FileResult{Name: name, Action: FileRemoved, Error: errors.Wrapf(err, "failed reading destination")})
+			return ds.ctx.Err()
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		if ds.excluded(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// Directories are removed along with all they hold.
+		if dir, ok := isDir[name]; !ok || dir != d.IsDir() {
+			extraneous = append(extraneous, name)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return ds.ctx.Err()
+	})
+	if err != nil {
+		return false
+	}
+
+	for _, name := range extraneous {
+		err := ds.dst.RemoveAll(name)
+		if err != nil {
+			err = errors.Wrapf(err, "failed removing %s", name)
+		}
+		if !ds.report(FileResult{Name: name, Action: FileRemoved, Error: err}) {
+			return false
+		}
+	}
+	return true
+}
+
+// syncFile syncs the destination file called name with the source one.
+func (ds *dirSync) syncFile(name string) (FileAction, error) {
+	info, err := fs.Stat(ds.src, name)
+	if err != nil {
+		return FileModified, err
+	}
+
+	old, err := fs.Stat(ds.dst, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileAdded, ds.copyFile(name, info, nil)
+	}
+	if err != nil {
+		return FileModified, err
+	}
+	if !old.Mode().IsRegular() {
+		return FileModified, errors.Errorf("gsync: destination %s is not a regular file", name)
+	}
+
+	unchanged, err := ds.unchanged(name, info, old)
+	if err != nil {
+		return FileModified, err
+	}
+	if unchanged {
+		return FileUnchanged, nil
+	}
+	return FileModified, ds.copyFile(name, info, old)
+}
+
+// findDuplicates returns the source files among names identical to an earlier one, in the order of names. Files
+// are hard links to the same file, or have the same size and checksum, in which case files of the same size are
+// read in full. Empty files, and files failing to be read, are left out.
+func (ds *dirSync) findDuplicates(names []string) map[string]duplicate {
+	var (
+		bySize = make(map[int64][]string)
+		infos  = make(map[string]fs.FileInfo)
+		sizes  []int64
+	)
+	for _, name := range names {
+		info, err := fs.Stat(ds.src, name)
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		if _, ok := bySize[info.Size()]; !ok {
+			sizes = append(sizes, info.Size())
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], name)
+		infos[name] = info
+	}
+
+	dups := make(map[string]duplicate)
+	for _, size := range sizes {
+		group := bySize[size]
+		if len(group) < 2 {
+			continue
+		}
+
+		var (
+			primaries []string
+			bySum     = make(map[string]string)
+		)
+	files:
+		for _, name := range group {
+			if ds.ctx.Err() != nil {
+				return nil
+			}
+
+			for _, p := range primaries {
+				if os.SameFile(infos[p], infos[name]) {
+					dups[name] = duplicate{primary: p, linked: true}
+					continue files
+				}
+			}
+
+			sum, err := checksumFile(ds.src, name)
+			if err != nil {
+				continue
+			}
+			if p, ok := bySum[string(sum)]; ok {
+				dups[name] = duplicate{primary: p}
+				continue
+			}
+			bySum[string(sum)] = name
+			primaries = append(primaries, name)
+		}
+	}
+	return dups
+}
+
+// syncDuplicate makes the destination file called name a copy of the destination file of d.primary, already
+// synced, or a hard link to it if both source files are linked and the destination is a LinkFS.
+func (ds *dirSync) syncDuplicate(name string, d duplicate) (FileAction, error) {
+	info, err := fs.Stat(ds.src, name)
+	if err != nil {
+		return FileModified, err
+	}
+
+	action := FileModified
+	old, err := fs.Stat(ds.dst, name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		action = FileAdded
+	case err != nil:
+		return FileModified, err
+	case !old.Mode().IsRegular():
+		return FileModified, errors.Errorf("gsync: destination %s is not a regular file", name)
+	}
+
+	l, link := ds.dst.(LinkFS)
+	link = link && d.linked
+
+	if action == FileModified {
+		var unchanged bool
+		if link {
+			primary, err := fs.Stat(ds.dst, d.primary)
+			unchanged = err == nil && os.SameFile(primary, old)
+		} else if unchanged, err = ds.unchanged(name, info, old); err != nil {
+			return FileModified, err
+		}
+		if unchanged {
+			return FileUnchanged, nil
+		}
+	}
+
+	if link {
+		return action, l.Link(d.primary, name)
+	}
+
+	err = ds.dst.WriteFile(name, func(w io.Writer) error {
+		f, err := ds.dst.Open(d.primary)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return action, err
+	}
+	return action, ds.setMetadata(name, info)
+}
+
+// unchanged tells whether the file called name is the same in both trees, info and old being its source and
+// destination file information.
+func (ds *dirSync) unchanged(name string, info, old fs.FileInfo) (bool, error) {
+	if info.Size() != old.Size() {
+		return false, nil
+	}
+
+	if !ds.opt.compareContents {
+		if ds.opt.preserveMetadata {
+			return info.ModTime().Equal(old.ModTime()), nil
+		}
+		return !old.ModTime().Before(info.ModTime()), nil
+	}
+
+	s, err := checksumFile(ds.src, name)
+	if err != nil {
+		return false, err
+	}
+
+	d, err := checksumFile(ds.dst, name)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(s, d), nil
+}
+
+// copyFile writes the source file called name to the destination, copying the blocks it shares with the
+// destination file, if old, its file information, is not nil.
+func (ds *dirSync) copyFile(name string, info, old fs.FileInfo) error {
+	ctx, cancel := context.WithCancel(ds.ctx)
+	defer cancel()
+
+	opts := ds.opts[:len(ds.opts):len(ds.opts)]
+	if ds.opt.blockSize == 0 {
+		size := info.Size()
+		if old != nil {
+			size = old.Size()
+		}
+		opts = append(opts, WithBlockSize(BlockSizeFor(size)))
+	}
+
+	var (
+		remote map[uint32][]BlockSignature
+		cache  io.ReaderAt
+	)
+
+	// Files not implementing io.ReaderAt cannot be copied blocks from, and are replaced in full.
+	if old != nil {
+		f, err := ds.dst.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if r, ok := f.(io.ReaderAt); ok {
+			sigs, err := ds.signatures(ctx, name, old, f, opts)
+			if err != nil {
+				return err
+			}
+
+			if remote, err = LookUpTable(ctx, sigs, opts...); err != nil {
+				return err
+			}
+			cache = r
+		}
+	}
+
+	ops, err := SyncFS(ctx, ds.src, name, nil, remote, opts...)
+	if err != nil {
+		return err
+	}
+
+	err = ds.dst.WriteFile(name, func(w io.Writer) error {
+		return Apply(ctx, w, cache, ops, opts...)
+	})
+	if err != nil {
+		return err
+	}
+	return ds.setMetadata(name, info)
+}
+
+// setMetadata gives the destination file called name the permissions and modification time of the source file,
+// info being its file information, if asked to with WithPreserveMetadata. Metadata the destination filesystem
+// can't represent is left as is.
+func (ds *dirSync) setMetadata(name string, info fs.FileInfo) error {
+	m, ok := ds.dst.(MetadataFS)
+	if !ds.opt.preserveMetadata || !ok {
+		return nil
+	}
+
+	if err := m.Chmod(name, info.Mode().Perm()); err != nil && !unsupported(err) {
+		return errors.Wrapf(err, "failed setting permissions")
+	}
+	if err := m.Chtimes(name, info.ModTime(), info.ModTime()); err != nil && !unsupported(err) {
+		return errors.Wrapf(err, "failed setting modification time")
+	}
+	return nil
+}
+
+// signatures returns the signatures of the destination file called name, read from f, taking them from the cache
+// set with WithSignatureCache, if any, while the file is unchanged since they were stored.
+func (ds *dirSync) signatures(ctx context.Context, name string, old fs.FileInfo, f io.Reader, opts []Option) (<-chan BlockSignature, error) {
+	c := ds.opt.signatureCache
+	if c == nil {
+		return Signatures(ctx, f, nil, opts...)
+	}
+
+	key := SignatureKey{Path: name, Size: old.Size(), ModTime: old.ModTime()}
+	cached, err := cachedSignatures(ctx, c, key, f, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := make(chan BlockSignature, len(cached))
+	for _, s := range cached {
+		sigs <- s
+	}
+	close(sigs)
+	return sigs, nil
+}
+
+// checksumFile returns the checksum of the whole content of the file called name.
+func checksumFile(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
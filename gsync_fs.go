@@ -0,0 +1,113 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.16
+// +build go1.16
+
+package gsync
+
+import (
+	"context"
+	"hash"
+	"io"
+	"io/fs"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// SignaturesFS works like Signatures, reading the file called name from fsys, so signatures can be calculated
+// from embedded filesystems, zip archives or test fixtures as well as from disk. The file is closed once
+// the returned channel is.
+func SignaturesFS(ctx context.Context, fsys fs.FS, name string, shash hash.Hash, opts ...Option) (<-chan BlockSignature, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening file")
+	}
+
+	c, err := startSignatures(ctx, f, shash, opts, func() { f.Close() })
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// SyncFS works like Sync, reading the file called name from fsys. Files not implementing io.ReaderAt are read
+// sequentially instead, buffering no more than the data Sync is working on. The file is closed once the
+// returned channel is.
+func SyncFS(ctx context.Context, fsys fs.FS, name string, shash hash.Hash, remote map[uint32][]BlockSignature, opts ...Option) (<-chan BlockOperation, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening file")
+	}
+
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		r = &sequentialReaderAt{r: f}
+	}
+
+	c, err := startSync(ctx, r, shash, remote, opts, func() { f.Close() })
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// sequentialReaderAt provides io.ReaderAt over a sequential reader, as long as offsets never go backwards,
+// which is how Sync reads its source. It keeps the data from the last offset read onwards buffered.
+type sequentialReaderAt struct {
+	r io.Reader
+	// buf holds the data read from r and not discarded yet, starting at buf[start], at offset off.
+	buf   []byte
+	start int
+	off   int64
+	err   error
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < s.off {
+		return 0, errors.Errorf("gsync: cannot read offset %d of a sequential reader past offset %d", off, s.off)
+	}
+
+	// Discards the data before off, buffered or not.
+	if skip := off - s.off; skip > 0 {
+		if buffered := int64(len(s.buf) - s.start); skip <= buffered {
+			s.start += int(skip)
+		} else {
+			s.buf, s.start = s.buf[:0], 0
+			if s.err == nil {
+				if _, err := io.CopyN(ioutil.Discard, s.r, skip-buffered); err != nil {
+					s.err = err
+				}
+			}
+		}
+		s.off = off
+	}
+
+	for len(s.buf)-s.start < len(p) && s.err == nil {
+		// Makes room for at least len(p) bytes, moving the buffered data to the front only when running out of
+		// space, so it happens once every len(p) bytes at most.
+		if cap(s.buf)-s.start < len(p) {
+			buf := s.buf[:cap(s.buf)]
+			if len(buf) < 2*len(p) {
+				buf = make([]byte, 2*len(p))
+			}
+			n := copy(buf, s.buf[s.start:])
+			s.buf, s.start = buf[:n], 0
+		}
+
+		n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+n]
+		s.err = err
+	}
+
+	n := copy(p, s.buf[s.start:])
+	if n < len(p) {
+		return n, s.err
+	}
+	return n, nil
+}
@@ -0,0 +1,317 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.16
+// +build go1.16
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+// sequentialFS hides the io.ReaderAt implementation of the files of its underlying filesystem.
+type sequentialFS struct {
+	fs.FS
+}
+
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	return struct{ fs.File }{f}, err
+}
+
+// TestSyncFS tests that files are signed and synced from filesystems, whether their files implement
+// io.ReaderAt or not.
+func TestSyncFS(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(142, 10*DefaultBlockSize+100)
+	source := append(append([]byte("prefix"), cache[:4*DefaultBlockSize]...), cache[5*DefaultBlockSize:]...)
+
+	fsys := fstest.MapFS{
+		"cache":  &fstest.MapFile{Data: cache},
+		"source": &fstest.MapFile{Data: source},
+	}
+
+	for _, fsys := range []fs.FS{fsys, sequentialFS{fsys}} {
+		sigs, err := SignaturesFS(ctx, fsys, "cache", nil)
+		assert.Ok(t, err)
+
+		remote, err := LookUpTable(ctx, sigs)
+		assert.Ok(t, err)
+
+		ops, err := SyncFS(ctx, fsys, "source", nil, remote)
+		assert.Ok(t, err)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops))
+		assert.Equals(t, source, target.Bytes())
+	}
+
+	_, err := SyncFS(ctx, fsys, "missing", nil, nil)
+	assert.Cond(t, err != nil, "opening a missing file should fail")
+}
+
+// noChmodFS is a MetadataFS whose filesystem can't represent permissions.
+type noChmodFS struct {
+	MetadataFS
+}
+
+func (noChmodFS) Chmod(name string, mode fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: syscall.ENOTSUP}
+}
+
+// deniedChmodFS is a MetadataFS refusing to change permissions.
+type deniedChmodFS struct {
+	MetadataFS
+}
+
+func (deniedChmodFS) Chmod(name string, mode fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrPermission}
+}
+
+// TestSyncDir tests that directory trees are synced, leaving unchanged and excluded files alone, and metadata
+// unless told to preserve it.
+func TestSyncDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cache := srand(255, 3*DefaultBlockSize)
+	source := append([]byte("prefix"), cache...)
+	src := fstest.MapFS{
+		"changed":     &fstest.MapFile{Data: source, ModTime: mtime},
+		"same":        &fstest.MapFile{Data: []byte("same"), ModTime: mtime},
+		"sub/new":     &fstest.MapFile{Data: []byte("new"), ModTime: mtime},
+		"sub/skipped": &fstest.MapFile{Data: []byte("skipped"), ModTime: mtime},
+		"file.tmp":    &fstest.MapFile{Data: []byte("tmp"), ModTime: mtime},
+	}
+
+	for name, data := range map[string][]byte{"changed": cache, "same": []byte("same"), "gone/file": nil, "keep.tmp": nil} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		assert.Ok(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.Ok(t, ioutil.WriteFile(p, data, 0644))
+		assert.Ok(t, os.Chtimes(p, mtime, mtime))
+	}
+
+	syncDir := func(opts ...Option) map[string]FileAction {
+		results, err := SyncDir(ctx, src, DirFS(dir), opts...)
+		assert.Ok(t, err)
+
+		actions := make(map[string]FileAction)
+		for r := range results {
+			assert.Ok(t, r.Error)
+			actions[r.Name] = r.Action
+		}
+		return actions
+	}
+
+	opts := []Option{WithExclude("*.tmp", "sub/skipped"), WithDeleteExtraneous()}
+	assert.Equals(t, map[string]FileAction{
+		"changed": FileModified,
+		"same":    FileUnchanged,
+		"sub/new": FileAdded,
+		"gone":    FileRemoved,
+	}, syncDir(opts...))
+
+	for name, data := range map[string][]byte{"changed": source, "same": []byte("same"), "sub/new": []byte("new"), "keep.tmp": {}} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		assert.Ok(t, err)
+		assert.Equals(t, data, b)
+	}
+
+	for _, name := range []string{"gone", "file.tmp", "sub/skipped"} {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		assert.Cond(t, os.IsNotExist(err), name+" should not exist")
+	}
+
+	// Synced files are more recent than the source ones, so they are left alone the next time.
+	assert.Equals(t, map[string]FileAction{
+		"changed": FileUnchanged,
+		"same":    FileUnchanged,
+		"sub/new": FileUnchanged,
+	}, syncDir(opts...))
+
+	// Preserved metadata tells files apart by their exact modification time instead.
+	src["sub/new"].Mode = 0600
+	assert.Equals(t, map[string]FileAction{
+		"changed": FileModified,
+		"same":    FileUnchanged,
+		"sub/new": FileModified,
+	}, syncDir(append(opts, WithPreserveMetadata())...))
+	assert.Equals(t, FileUnchanged, syncDir(append(opts, WithPreserveMetadata())...)["sub/new"])
+
+	info, err := os.Stat(filepath.Join(dir, "sub", "new"))
+	assert.Ok(t, err)
+	assert.Cond(t, info.ModTime().Equal(mtime), "modification time should be preserved")
+	if runtime.GOOS != "windows" {
+		assert.Equals(t, fs.FileMode(0600), info.Mode().Perm())
+	}
+
+	// Only checksums tell files of the same size and modification time apart.
+	src["same"] = &fstest.MapFile{Data: []byte("diff"), ModTime: mtime}
+	assert.Equals(t, FileUnchanged, syncDir()["same"])
+	assert.Equals(t, FileModified, syncDir(WithCompareContents())["same"])
+
+	// Filesystems unable to represent permissions still get the content.
+	src["same"] = &fstest.MapFile{Data: []byte("same"), Mode: 0600, ModTime: mtime.Add(time.Hour)}
+	results, err := SyncDir(ctx, src, noChmodFS{DirFS(dir)}, WithExclude("*.tmp", "sub/skipped"), WithPreserveMetadata())
+	assert.Ok(t, err)
+	for r := range results {
+		assert.Ok(t, r.Error)
+	}
+	info, err = os.Stat(filepath.Join(dir, "same"))
+	assert.Ok(t, err)
+	assert.Cond(t, info.ModTime().Equal(mtime.Add(time.Hour)), "modification time should be preserved")
+
+	// Permission errors are real failures, though.
+	src["same"] = &fstest.MapFile{Data: []byte("same"), Mode: 0600, ModTime: mtime.Add(2 * time.Hour)}
+	results, err = SyncDir(ctx, src, deniedChmodFS{DirFS(dir)}, WithExclude("*.tmp", "sub/skipped"), WithPreserveMetadata())
+	assert.Ok(t, err)
+	var denied int
+	for r := range results {
+		if r.Error != nil {
+			assert.Equals(t, "same", r.Name)
+			assert.Cond(t, errors.Is(r.Error, fs.ErrPermission), "permission errors should be reported")
+			denied++
+		}
+	}
+	assert.Equals(t, 1, denied)
+
+	_, err = SyncDir(ctx, src, DirFS(dir), WithExclude("["))
+	assert.Cond(t, err != nil, "invalid exclude patterns should fail")
+}
+
+// countingCache is a SignatureCache counting the signatures stored in it.
+type countingCache struct {
+	MemorySignatureCache
+	puts int
+}
+
+func (c *countingCache) Put(key SignatureKey, sigs []BlockSignature) {
+	c.puts++
+	c.MemorySignatureCache.Put(key, sigs)
+}
+
+// TestSyncDirSignatureCache tests that SyncDir takes the signatures of destination files from the cache, and
+// stores the ones it reads.
+func TestSyncDirSignatureCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cache := srand(2551, 3*DefaultBlockSize)
+	p := filepath.Join(dir, "file")
+	assert.Ok(t, ioutil.WriteFile(p, cache, 0644))
+	assert.Ok(t, os.Chtimes(p, mtime, mtime))
+
+	c := new(countingCache)
+	sync := func(data []byte) {
+		src := fstest.MapFS{"file": &fstest.MapFile{Data: data, ModTime: time.Now()}}
+		results, err := SyncDir(ctx, src, DirFS(dir), WithSignatureCache(c))
+		assert.Ok(t, err)
+		for r := range results {
+			assert.Ok(t, r.Error)
+			assert.Equals(t, FileModified, r.Action)
+		}
+
+		b, err := ioutil.ReadFile(p)
+		assert.Ok(t, err)
+		assert.Equals(t, data, b)
+	}
+
+	// Signatures are read and stored, keyed by the destination file.
+	sync(append([]byte("prefix"), cache...))
+	assert.Equals(t, 1, c.puts)
+	_, ok := c.Get(SignatureKey{Path: "file", Size: int64(len(cache)), ModTime: mtime})
+	assert.Cond(t, ok, "signatures of the destination file should be cached")
+
+	// Cached signatures are used while the destination file is unchanged.
+	info, err := os.Stat(p)
+	assert.Ok(t, err)
+	sigs, err := SignaturesFS(ctx, DirFS(dir), "file", nil, WithBlockSize(BlockSizeFor(info.Size())))
+	assert.Ok(t, err)
+	var cached []BlockSignature
+	for s := range sigs {
+		cached = append(cached, s)
+	}
+	c.MemorySignatureCache.Put(SignatureKey{Path: "file", Size: info.Size(), ModTime: info.ModTime()}, cached)
+
+	sync([]byte("suffix"))
+	assert.Equals(t, 1, c.puts)
+}
+
+// TestSyncDirDeduplicate tests that the content of identical source files is synced once, and that hard links
+// are kept.
+func TestSyncDirDeduplicate(t *testing.T) {
+	ctx := context.Background()
+	data := srand(1471, 2*DefaultBlockSize)
+	src := fstest.MapFS{
+		"a":     &fstest.MapFile{Data: data},
+		"sub/b": &fstest.MapFile{Data: data},
+		"c":     &fstest.MapFile{Data: append([]byte("c"), data[1:]...)},
+	}
+
+	syncDir := func(src fs.FS, dst WritableFS, opts ...Option) (map[string]FileAction, int64) {
+		var literal int64
+		opts = append(opts, WithDeduplicateIdentical(), WithLiteralRanges(func(start, length int64) {
+			literal += length
+		}))
+		results, err := SyncDir(ctx, src, dst, opts...)
+		assert.Ok(t, err)
+
+		actions := make(map[string]FileAction)
+		for r := range results {
+			assert.Ok(t, r.Error)
+			actions[r.Name] = r.Action
+		}
+		return actions, literal
+	}
+
+	dir := t.TempDir()
+	actions, literal := syncDir(src, DirFS(dir))
+	assert.Equals(t, map[string]FileAction{"a": FileAdded, "sub/b": FileAdded, "c": FileAdded}, actions)
+	assert.Equals(t, int64(2*len(data)), literal)
+	for name, f := range src {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		assert.Ok(t, err)
+		assert.Equals(t, f.Data, b)
+	}
+
+	actions, literal = syncDir(src, DirFS(dir))
+	assert.Equals(t, map[string]FileAction{"a": FileUnchanged, "sub/b": FileUnchanged, "c": FileUnchanged}, actions)
+	assert.Equals(t, int64(0), literal)
+
+	// Hard links in the source are hard links in the destination.
+	srcDir := t.TempDir()
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(srcDir, "a"), data, 0644))
+	if err := os.Link(filepath.Join(srcDir, "a"), filepath.Join(srcDir, "b")); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+
+	dir = t.TempDir()
+	actions, _ = syncDir(os.DirFS(srcDir), DirFS(dir))
+	assert.Equals(t, map[string]FileAction{"a": FileAdded, "b": FileAdded}, actions)
+
+	a, err := os.Stat(filepath.Join(dir, "a"))
+	assert.Ok(t, err)
+	b, err := os.Stat(filepath.Join(dir, "b"))
+	assert.Ok(t, err)
+	assert.Cond(t, os.SameFile(a, b), "destination files should be linked")
+
+	actions, _ = syncDir(os.DirFS(srcDir), DirFS(dir))
+	assert.Equals(t, map[string]FileAction{"a": FileUnchanged, "b": FileUnchanged}, actions)
+}
@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.18
+// +build go1.18
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// maxFuzzSize caps the size of the files fuzz tests sync, a few blocks are enough to cover block boundaries
+// and partial blocks.
+const maxFuzzSize = 8 * DefaultBlockSize
+
+// roundTrip syncs source against basis and applies the result, returning the reconstructed file and the
+// number of literal bytes sent.
+func roundTrip(t *testing.T, basis, source []byte) ([]byte, int) {
+	ctx := context.Background()
+
+	sigs, err := Signatures(ctx, bytes.NewReader(basis), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := LookUpTable(ctx, sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts literal bytes on the way to Apply.
+	literals := 0
+	counted := make(chan BlockOperation)
+	go func() {
+		defer close(counted)
+		for o := range ops {
+			literals += len(o.Data)
+			counted <- o
+		}
+	}()
+
+	target := new(bytes.Buffer)
+	if err := Apply(ctx, target, bytes.NewReader(basis), counted); err != nil {
+		t.Fatal(err)
+	}
+	Drain(counted)
+
+	return target.Bytes(), literals
+}
+
+// FuzzSyncIdentity checks that syncing a file against an identical copy sends no literal data at all and
+// reconstructs the file exactly.
+func FuzzSyncIdentity(f *testing.F) {
+	for _, size := range []uint32{0, 1, DefaultBlockSize - 1, DefaultBlockSize, DefaultBlockSize + 1, 3*DefaultBlockSize + 17} {
+		f.Add(int64(size), size)
+	}
+
+	f.Fuzz(func(t *testing.T, seed int64, size uint32) {
+		data := srand(seed, int(size%maxFuzzSize))
+
+		target, literals := roundTrip(t, data, data)
+		if literals != 0 {
+			t.Fatalf("%d literal bytes sent for identical files of %d bytes", literals, len(data))
+		}
+		if !bytes.Equal(data, target) {
+			t.Fatalf("reconstructed file differs from the source")
+		}
+	})
+}
+
+// FuzzSyncEdits checks that syncing an edited copy of a file, with data cut at pos and replaced with insert,
+// reconstructs it exactly.
+func FuzzSyncEdits(f *testing.F) {
+	f.Add(int64(1), uint32(3*DefaultBlockSize), uint32(10), uint16(0), []byte("inserted"))
+	f.Add(int64(2), uint32(3*DefaultBlockSize+5), uint32(DefaultBlockSize), uint16(DefaultBlockSize), []byte(nil))
+	f.Add(int64(3), uint32(DefaultBlockSize/2), uint32(0), uint16(100), []byte("x"))
+	f.Add(int64(4), uint32(5*DefaultBlockSize), uint32(5*DefaultBlockSize), uint16(0), []byte("appended"))
+
+	f.Fuzz(func(t *testing.T, seed int64, size, pos uint32, cut uint16, insert []byte) {
+		basis := srand(seed, int(size%maxFuzzSize))
+
+		p := int(pos) % (len(basis) + 1)
+		end := p + int(cut)
+		if end > len(basis) {
+			end = len(basis)
+		}
+
+		source := append(append(append([]byte(nil), basis[:p]...), insert...), basis[end:]...)
+
+		target, _ := roundTrip(t, basis, source)
+		if !bytes.Equal(source, target) {
+			t.Fatalf("reconstructed file differs from the source")
+		}
+	})
+}
@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+// MerkleSignature is a Merkle tree over the strong checksums of a file's blocks. Comparing two trees top-down
+// only descends into subtrees that differ, which makes finding the changed blocks of huge files proportional
+// to the number of changes instead of the number of blocks.
+//
+// Leaves are the strong checksums of blocks, in index order. Every inner node is the hash of its two children
+// concatenated, or a copy of its only child when it has one.
+type MerkleSignature struct {
+	// levels holds the tree nodes, bottom-up. levels[0] are the leaves and the last level the root.
+	levels [][][]byte
+}
+
+// NewMerkleSignature builds a MerkleSignature from the block signatures read from bc, hashing inner nodes with h,
+// or SHA-256 if h is nil. Both ends must use the same strong hash and h for their trees to be comparable.
+// Signatures must cover all blocks in index order, starting at 0.
+func NewMerkleSignature(ctx context.Context, bc <-chan BlockSignature, h hash.Hash) (*MerkleSignature, error) {
+	if h == nil {
+		h = sha256.New()
+	}
+
+	var leaves [][]byte
+	for s := range bc {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "failed building merkle tree")
+		default:
+			break
+		}
+
+		if s.Error != nil {
+			return nil, errors.Wrapf(s.Error, "failed building merkle tree")
+		}
+
+		if s.Index != uint64(len(leaves)) {
+			return nil, errors.Errorf("gsync: signature of block %d out of order, expected block %d", s.Index, len(leaves))
+		}
+		leaves = append(leaves, s.Strong)
+	}
+
+	m := &MerkleSignature{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			h.Reset()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+
+		m.levels = append(m.levels, next)
+		level = next
+	}
+
+	return m, nil
+}
+
+// Root returns the root hash of the tree, or nil if the tree has no blocks.
+func (m *MerkleSignature) Root() []byte {
+	top := m.levels[len(m.levels)-1]
+	if len(top) == 0 {
+		return nil
+	}
+	return top[0]
+}
+
+// Blocks returns the number of blocks in the tree.
+func (m *MerkleSignature) Blocks() uint64 {
+	return uint64(len(m.levels[0]))
+}
+
+// node returns the i-th node of the given level, reporting false if there is no such node.
+func (m *MerkleSignature) node(level, i int) ([]byte, bool) {
+	if level >= len(m.levels) || i >= len(m.levels[level]) {
+		return nil, false
+	}
+	return m.levels[level][i], true
+}
+
+// DiffMerkle returns, in ascending order, the indexes of the blocks that differ between a and b, including
+// the blocks only one of them has.
+func DiffMerkle(a, b *MerkleSignature) []uint64 {
+	height := len(a.levels)
+	if len(b.levels) > height {
+		height = len(b.levels)
+	}
+
+	var changed []uint64
+	diffMerkle(a, b, height-1, 0, &changed)
+	return changed
+}
+
+// diffMerkle compares the i-th nodes of the given level of a and b, descending into their children when they differ.
+func diffMerkle(a, b *MerkleSignature, level, i int, changed *[]uint64) {
+	ha, oka := a.node(level, i)
+	hb, okb := b.node(level, i)
+
+	switch {
+	case !oka && !okb:
+		// Either the node is past the end of both trees, or we are above the root of the shorter tree
+		// and the node has to be looked for further down.
+		if i > 0 || level == 0 {
+			return
+		}
+	case oka && okb && bytes.Equal(ha, hb):
+		return
+	}
+
+	if level == 0 {
+		*changed = append(*changed, uint64(i))
+		return
+	}
+
+	diffMerkle(a, b, level-1, 2*i, changed)
+	diffMerkle(a, b, level-1, 2*i+1, changed)
+}
@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DestinationErrors reports the destinations ApplyMulti failed writing to.
+type DestinationErrors map[int]error
+
+// Error implements error.
+func (e DestinationErrors) Error() string {
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, 0, len(e))
+	for _, i := range indexes {
+		msgs = append(msgs, fmt.Sprintf("destination %d: %v", i, e[i]))
+	}
+	return "gsync: failed writing to destinations: " + strings.Join(msgs, "; ")
+}
+
+// ApplyMulti works like Apply, writing every reconstructed block to all the destinations in dsts, so
+// a delta can be applied to several replicas in a single pass over the operations and the cached file.
+//
+// By default, ApplyMulti stops as soon as writing to any destination fails. With WithContinueOnWriteError,
+// it stops writing to the failed destinations only, and keeps going while any destination is left.
+// Either way, write failures are reported with a DestinationErrors, keyed by the position of the
+// destinations in dsts, as the error cause.
+func ApplyMulti(ctx context.Context, dsts []io.Writer, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	if len(dsts) == 0 {
+		return errors.New("gsync: destination required")
+	}
+
+	f := &fanout{
+		dsts:             dsts,
+		errs:             make(DestinationErrors),
+		continueOnErrors: newOptions(opts).continueOnWriteError,
+	}
+
+	if err := Apply(ctx, f, cache, ops, opts...); err != nil {
+		return err
+	}
+
+	if len(f.errs) > 0 {
+		return f.errs
+	}
+	return nil
+}
+
+// fanout writes to several destinations, keeping track of the ones that failed.
+type fanout struct {
+	dsts             []io.Writer
+	errs             DestinationErrors
+	continueOnErrors bool
+}
+
+// Write implements io.Writer. It only fails if the failed destinations have to stop the process.
+func (f *fanout) Write(p []byte) (int, error) {
+	for i, d := range f.dsts {
+		if _, failed := f.errs[i]; failed {
+			continue
+		}
+
+		if _, err := d.Write(p); err != nil {
+			f.errs[i] = err
+		}
+	}
+
+	return len(p), f.err()
+}
+
+// Flush finalizes every destination left, so Apply's own finalization reaches all of them.
+func (f *fanout) Flush() error {
+	for i, d := range f.dsts {
+		if _, failed := f.errs[i]; failed {
+			continue
+		}
+
+		if err := finalize(d); err != nil {
+			f.errs[i] = err
+		}
+	}
+
+	return f.err()
+}
+
+// err returns the errors of the failed destinations if they have to stop the process.
+func (f *fanout) err() error {
+	if len(f.errs) == 0 || (f.continueOnErrors && len(f.errs) < len(f.dsts)) {
+		return nil
+	}
+	return f.errs
+}
@@ -0,0 +1,521 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultReadSize is the default size of the reads Signatures issues to its reader.
+const DefaultReadSize = 1024 * 1024 // 1mb
+
+// Option customizes the behavior of Signatures, Sync or Apply. Functions ignore options that do not apply to them.
+type Option func(*options)
+
+// options holds the settings shared by all the stages of the sync process.
+type options struct {
+	// maxOutputBytes caps the number of bytes Apply writes to its destination. Zero means no limit.
+	maxOutputBytes int64
+	// transform is applied by Apply to every block right before writing it.
+	transform func(index uint64, data []byte) ([]byte, error)
+	// startIndex is the index Signatures assigns to the first block it reads.
+	startIndex uint64
+	// startOffset is the offset, within the whole file, of the first block Signatures reads.
+	startOffset int64
+	// dictionary is matched against by Sync and copied from by Apply.
+	dictionary *Dictionary
+	// decoder decodes the source and the cached copy of the file before they are signed, synced or copied from.
+	decoder Decoder
+	// encoder encodes Apply's output.
+	encoder Encoder
+	// logger receives debug output. Nil means no logging at all.
+	logger Logger
+	// checkpoint receives the position Signatures reached, every checkpointEvery blocks.
+	checkpoint      io.Writer
+	checkpointEvery uint64
+	// writeBatchSize is the number of bytes Apply buffers before writing to its destination.
+	writeBatchSize int
+	// readSize is the size of the reads Signatures issues to its reader.
+	readSize int
+	// continueOnWriteError keeps ApplyMulti going when some of its destinations fail.
+	continueOnWriteError bool
+	// maxBucketDepth caps the number of signatures sharing a weak checksum in the lookup table. Zero means no limit.
+	maxBucketDepth int
+	// literalRanges receives the ranges of the source Sync sends as literal data.
+	literalRanges func(start, length int64)
+	// indexSalt feeds block indexes into strong checksums.
+	indexSalt bool
+	// timeout bounds the duration of every call. Zero means no limit other than the caller's context.
+	timeout time.Duration
+	// readAhead is the number of blocks of the cached file Apply reads at once, fetching the following ones in
+	// the background. Zero disables read-ahead.
+	readAhead int
+	// allocator hands out the working buffers. Nil means buffers are pooled, without limit.
+	allocator BufferAllocator
+	// accessPlan receives the indexes of the basis blocks Apply is about to copy.
+	accessPlan func(indices []uint64)
+	// stats receives the statistics of Sync or Apply.
+	stats *Stats
+	// progress receives the statistics of Sync or Apply as they go.
+	progress func(Stats)
+	// strongFallback is the ratio of confirmed weak matches below which Sync stops relying on weak checksums.
+	// Zero disables the fallback.
+	strongFallback float64
+	// preallocate is the size of disk space Apply reserves for its destination. Zero disables preallocation.
+	preallocate int64
+	// blockSize is the size of the blocks files are split in. Zero means unset, DefaultBlockSize is used then.
+	blockSize int
+	// hashKey is hashed ahead of every block by strong checksums, and keys the file checksum.
+	hashKey []byte
+	// weakTable maps bytes to the values weak checksums sum, derived from hashKey. Nil means bytes are summed.
+	weakTable *[256]uint32
+	// excludes are the glob patterns of the paths SyncDir leaves alone.
+	excludes []string
+	// deleteExtraneous makes SyncDir remove destination files missing from the source.
+	deleteExtraneous bool
+	// compareContents makes SyncDir compare files by checksum instead of by size and modification time.
+	compareContents bool
+	// signatureCache holds the signatures of the destination files SyncDir syncs against.
+	signatureCache SignatureCache
+	// preserveMetadata makes SyncDir give destination files the permissions and modification time of the source.
+	preserveMetadata bool
+	// deduplicateIdentical makes SyncDir sync the content of identical source files once.
+	deduplicateIdentical bool
+	// compressor compresses the literal data Sync sends, and decompresses it in Apply.
+	compressor Compressor
+	// concurrency is the number of workers Signatures hashes blocks with. Zero or one means blocks are hashed
+	// one after the other.
+	concurrency int
+	// bufferReuse makes Sync send literal data in pooled buffers, given back with BlockOperation.Release.
+	bufferReuse bool
+	// channelBuffer is the capacity of the channels Signatures and Sync send over.
+	channelBuffer int
+}
+
+// strongFallbackSample is the number of weak matches Sync waits for before considering WithStrongFallback.
+const strongFallbackSample = 1024
+
+// newOptions returns the settings resulting from applying opts over the defaults.
+func newOptions(opts []Option) *options {
+	o := &options{
+		readSize: DefaultReadSize,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// blockLen returns the block size in use.
+func (o *options) blockLen() int {
+	if o.blockSize > 0 {
+		return o.blockSize
+	}
+	return DefaultBlockSize
+}
+
+// literalLen returns the most data Sync sends in a single literal operation, which is MaxBlockSize, or the block
+// size if larger. Literals hold several blocks of data at smaller block sizes, cutting down on operations.
+func (o *options) literalLen() int {
+	if n := o.blockLen(); n > MaxBlockSize {
+		return n
+	}
+	return MaxBlockSize
+}
+
+// weak calculates the weak checksum of block, keyed if asked to.
+func (o *options) weak(block []byte) (uint32, uint32, uint32) {
+	if o.weakTable != nil {
+		return keyedRollingHash(o.weakTable, block)
+	}
+	return rollingHash(block)
+}
+
+// weakValue returns the value b adds to weak checksums.
+func (o *options) weakValue(b byte) uint32 {
+	if o.weakTable != nil {
+		return o.weakTable[b]
+	}
+	return uint32(b)
+}
+
+// fileHash returns the hash of the whole file checksum, see BlockOperation.Checksum.
+func (o *options) fileHash() hash.Hash {
+	if len(o.hashKey) > 0 {
+		return hmac.New(sha256.New, o.hashKey)
+	}
+	return sha256.New()
+}
+
+// validateStart makes sure the start offset is the boundary of the start block.
+func (o *options) validateStart() error {
+	if o.startOffset != int64(o.startIndex)*int64(o.blockLen()) {
+		return errors.Errorf("gsync: start offset %d is not the boundary of block %d", o.startOffset, o.startIndex)
+	}
+	return nil
+}
+
+// withTimeout derives the context a call runs under from the caller's one, bounded by the timeout, if any.
+// The returned cancel function must always be called.
+func (o *options) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+// timedOut returns ErrTimeout in place of err when err stems from ctx, derived with withTimeout, running out
+// of time while the caller's parent context is still alive.
+func timedOut(parent, ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return ErrTimeout
+	}
+	return err
+}
+
+// WithMaxOutputBytes makes Apply fail with ErrOutputTooLarge, before writing anything past the limit,
+// when the reconstructed file would be larger than n bytes. It protects servers applying deltas
+// from untrusted sources from filling up their disks.
+func WithMaxOutputBytes(n int64) Option {
+	return func(o *options) {
+		o.maxOutputBytes = n
+	}
+}
+
+// WithBlockTransform makes Apply pass every reconstructed block through fn right before writing it to
+// its destination, allowing for decryption, format conversion or instrumentation. fn sees the plain block
+// data for both copied and literal blocks, along with the block index of the operation, which is always
+// zero for literal blocks. The returned slice is written instead of data and may have a different length.
+// A non-nil error aborts Apply. fn must not retain data, since its underlying buffer is reused.
+func WithBlockTransform(fn func(index uint64, data []byte) ([]byte, error)) Option {
+	return func(o *options) {
+		o.transform = fn
+	}
+}
+
+// WithStartIndex makes Signatures number blocks starting at index instead of zero, for when the reader
+// only holds data appended to a file whose preceding blocks are already signed. The resulting signatures
+// can be merged with the existing ones as they are. offset is the position of the first block within the
+// whole file and it must be the boundary of block index, or Signatures fails.
+func WithStartIndex(index uint64, offset int64) Option {
+	return func(o *options) {
+		o.startIndex = index
+		o.startOffset = offset
+	}
+}
+
+// WithDictionary makes Sync look for blocks in d when they are not found among the remote blocks, and
+// Apply copy those blocks from d. Apply fails if it finds blocks copied from a different dictionary version.
+func WithDictionary(d *Dictionary) Option {
+	return func(o *options) {
+		o.dictionary = d
+	}
+}
+
+// WithTranscoder makes gsync work on the decoded contents of files, which is how already compressed files
+// have to be synced, since a tiny change in their contents alters the whole compressed stream.
+// Signatures and Sync decode their input with dec, and Apply decodes the cached copy with dec and encodes
+// the reconstructed file with enc. Sync and Apply need random access to the decoded data, so they decode
+// it in memory.
+//
+// The reconstructed file is only byte-identical to the source if enc is deterministic and produces exactly
+// the same output as the encoder the source was created with. When that can't be guaranteed, a nil enc
+// makes Apply store the decoded contents as they are.
+func WithTranscoder(dec Decoder, enc Encoder) Option {
+	return func(o *options) {
+		o.decoder = dec
+		o.encoder = enc
+	}
+}
+
+// WithLogger makes Sync and Apply log every operation they send or apply, with its kind, block index and size,
+// and LookUpTable log the signatures it skips because of errors. Nothing is logged by default.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithCheckpoint makes Signatures write its position to w every n blocks, and once more when done, so an
+// interrupted scan can be continued with ResumeSignatures. A checkpoint is written once the signatures of
+// the blocks before it were handed over, and only records the position: persisting those signatures is up to
+// the caller. Each checkpoint is a fixed size record appended to w. ApplyAt records its position the same way,
+// every n operations, to be continued with ResumeApplyAt.
+func WithCheckpoint(w io.Writer, n uint64) Option {
+	return func(o *options) {
+		if n == 0 {
+			n = 1
+		}
+		o.checkpoint = w
+		o.checkpointEvery = n
+	}
+}
+
+// WithWriteBatchSize makes Apply accumulate consecutive blocks, copied or literal, and write them to its
+// destination in batches of n bytes, instead of issuing a write per block. It reduces the write calls for
+// small blocks or slow destinations, like network filesystems. The last partial batch is written before
+// Apply returns successfully.
+func WithWriteBatchSize(n int) Option {
+	return func(o *options) {
+		o.writeBatchSize = n
+	}
+}
+
+// WithReadSize makes Signatures read from its reader in chunks of n bytes and carve blocks out of them, instead
+// of issuing a read per block, which for small blocks means a lot of syscalls. It defaults to DefaultReadSize.
+// Sizes not larger than the block size make Signatures read one block at a time.
+func WithReadSize(n int) Option {
+	return func(o *options) {
+		o.readSize = n
+	}
+}
+
+// WithContinueOnWriteError makes ApplyMulti keep writing to the remaining destinations when writing to some
+// of them fails. The failures are still reported once all operations are applied.
+func WithContinueOnWriteError() Option {
+	return func(o *options) {
+		o.continueOnWriteError = true
+	}
+}
+
+// WithMaxBucketDepth makes LookUpTable, and Syncer.LoadSignatures, keep at most n signatures per weak checksum,
+// dropping any further ones. Files with extreme block repetition can otherwise pile up thousands of candidates
+// under a single weak checksum, turning every Sync probe into thousands of strong checksum comparisons.
+// The price is missing matches with the dropped blocks. How many were dropped is logged with WithLogger.
+func WithMaxBucketDepth(n int) Option {
+	return func(o *options) {
+		o.maxBucketDepth = n
+	}
+}
+
+// WithLiteralRanges makes Sync call fn with every range of the source it could not find in the remote blocks
+// and sends as literal data, in source offsets, as they are found. Adjacent literal bytes are reported as a
+// single range. fn is called from Sync's goroutine.
+func WithLiteralRanges(fn func(start, length int64)) Option {
+	return func(o *options) {
+		o.literalRanges = fn
+	}
+}
+
+// WithIndexSalt makes Signatures hash the index of every block ahead of its data when calculating its strong
+// checksum, and Sync do the same with the block index of the source position it is probing when confirming
+// matches. Identical blocks at different positions get different strong checksums, so a block can never be
+// confused with one from another position. By design, this disables deduplication across positions: a basis
+// block can only be copied to the same block position of the source, and moved data is sent as literals.
+// Both ends must agree on salting or nothing matches.
+func WithIndexSalt() Option {
+	return func(o *options) {
+		o.indexSalt = true
+	}
+}
+
+// WithTimeout bounds the duration of each Signatures, SignaturesFunc, Sync or Apply call to d, without having to
+// derive a context for each of them. Calls running out of time fail with ErrTimeout, which callers can tell
+// apart from the cancellation of their own context.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithReadAhead makes Apply read the cached copy of the file in batches of the given number of blocks, fetching
+// the batch following the one being copied from in the background. With high-latency caches, like files
+// accessed over SFTP, copies of consecutive blocks then mostly avoid waiting for a round-trip each. Read-ahead
+// never reads past the end of the cache and stops along with the context.
+func WithReadAhead(blocks int) Option {
+	return func(o *options) {
+		o.readAhead = blocks
+	}
+}
+
+// WithBufferAllocator makes Signatures, Sync and Apply take their working buffers from a, so the memory used by
+// all the syncs sharing it can be capped, with a LimitedAllocator for instance. This covers the buffers blocks
+// are read into, as well as the read buffer set with WithReadSize, but not the literal data Sync hands over
+// to its caller. Calls wait for a to grant their buffers, or for their context to be done. Calls running in
+// a pipeline, like a Sync feeding an Apply, hold their buffers at the same time, so a limit too low for all
+// of them stalls the pipeline until its context is done.
+func WithBufferAllocator(a BufferAllocator) Option {
+	return func(o *options) {
+		o.allocator = a
+	}
+}
+
+// WithBasisAccessPlan makes Apply report the indexes of the basis blocks it is about to copy, in the order it
+// copies them, before reading any of them, so a prefetch layer can warm them up. Apply looks ahead at the
+// operations already sent, up to a few hundred at a time, and calls fn with the blocks of each batch. When
+// the whole delta is sent up front, as from a buffered channel, fn sees most of it in its first call.
+func WithBasisAccessPlan(fn func(indices []uint64)) Option {
+	return func(o *options) {
+		o.accessPlan = fn
+	}
+}
+
+// WithStats makes Sync fill in s with its statistics right before sending the final operation, so they can be
+// read once the final operation is received, or Apply returns. Apply fills in s with its own statistics once
+// done, so each needs its own Stats.
+func WithStats(s *Stats) Option {
+	return func(o *options) {
+		o.stats = s
+	}
+}
+
+// WithProgress makes Sync and Apply call fn with their statistics so far, every 100ms at most while going
+// through the source or the operations, and once more when done, as they send the final operation or
+// return. fn is called from the goroutine doing the work, and must not block.
+func WithProgress(fn func(Stats)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithStrongFallback makes Sync stop relying on weak checksums when they are mostly false matches, as with data
+// that weak checksums distribute poorly. Sync keeps track of the ratio of weak matches confirmed by the strong
+// checksum and, once it has seen at least 1024 weak matches, if the ratio drops below floor, it switches to
+// calculating the strong checksum of every position and looking blocks up by it alone, which Stats records.
+// The fallback is disabled by default. A floor around 0.1 only kicks in when nine weak matches out of ten are
+// false.
+func WithStrongFallback(floor float64) Option {
+	return func(o *options) {
+		o.strongFallback = floor
+	}
+}
+
+// WithPreallocate makes Apply reserve size bytes of disk space for its destination up front, when it is an
+// *os.File, so a full disk is reported before writing anything rather than midway through, and the file is less
+// fragmented. size is the size of the reconstructed file, as reported by PatchFile.Size or announced by the
+// sender. Preallocation relies on fallocate and is only supported on Linux, it does nothing elsewhere, or
+// on filesystems not supporting it.
+func WithPreallocate(size int64) Option {
+	return func(o *options) {
+		o.preallocate = size
+	}
+}
+
+// WithBlockSize sets the size of the blocks files are split in, DefaultBlockSize by default. Small blocks find
+// more matches but make for larger signatures, and BlockSizeFor picks a size suited to a given file. Signatures
+// record their block size, so Sync uses the block size of the remote signatures unless told otherwise, and
+// fails with ErrBlockSizeMismatch if told a different one. Apply, and everything else dealing with block
+// indexes, must be given the same block size.
+func WithBlockSize(n int) Option {
+	return func(o *options) {
+		o.blockSize = n
+	}
+}
+
+// WithHashKey mixes key into both checksums, so that blocks whose weak or strong checksums collide cannot be
+// crafted without knowing it, and keys the checksum of the whole file Sync sends along with the final operation,
+// see BlockOperation.Checksum. Both ends must use the same key, ideally a random one per session. Signatures
+// calculated with a different key, or none, do not match.
+func WithHashKey(key []byte) Option {
+	return func(o *options) {
+		o.hashKey = append([]byte(nil), key...)
+		o.weakTable = nil
+		if len(key) > 0 {
+			o.weakTable = newWeakTable(key)
+		}
+	}
+}
+
+// WithExclude makes SyncDir leave alone the paths matching any of patterns, whether in the source or in the
+// destination. Patterns follow path.Match, and are matched against both slash-separated paths and base names,
+// so "*.tmp" excludes temporary files anywhere in the tree. Excluding a directory excludes all it holds.
+func WithExclude(patterns ...string) Option {
+	return func(o *options) {
+		o.excludes = append(o.excludes, patterns...)
+	}
+}
+
+// WithDeleteExtraneous makes SyncDir remove the destination files and directories missing from the source,
+// or replaced in it by a different kind of entry.
+func WithDeleteExtraneous() Option {
+	return func(o *options) {
+		o.deleteExtraneous = true
+	}
+}
+
+// WithCompareContents makes SyncDir tell modified files apart by the checksum of their whole content, instead
+// of by size and modification time. It reads every file on both sides, but catches changes leaving both alone.
+func WithCompareContents() Option {
+	return func(o *options) {
+		o.compareContents = true
+	}
+}
+
+// WithPreserveMetadata makes SyncDir give the destination files and the directories it creates the permissions,
+// and files the modification time, of the source ones, if the destination is a MetadataFS. Metadata the
+// destination filesystem can't represent, as permissions on FAT filesystems, is left as is.
+func WithPreserveMetadata() Option {
+	return func(o *options) {
+		o.preserveMetadata = true
+	}
+}
+
+// WithDeduplicateIdentical makes SyncDir sync the content of identical source files once, copying it over to the
+// destination files of the others. Source files are identical when hard links to the same file, whose
+// destination files are hard links as well if the destination is a LinkFS, or when their content is, which takes
+// reading in full the source files of the same size. It pays off for trees with many duplicate files.
+func WithDeduplicateIdentical() Option {
+	return func(o *options) {
+		o.deduplicateIdentical = true
+	}
+}
+
+// WithSignatureCache makes SyncDir take the signatures of destination files from c, through CachedSignatures,
+// instead of reading them in full every time. Signatures are keyed by the slash-separated path of the file
+// within the destination tree, its size and modification time, so c must only be used with a single tree.
+func WithSignatureCache(c SignatureCache) Option {
+	return func(o *options) {
+		o.signatureCache = c
+	}
+}
+
+// WithCompression makes Sync compress the data of literal operations with c, sending as is the blocks compression
+// does not make smaller, see BlockOperation.Compression. Apply decompresses the operations compressed with c,
+// and those compressed by GzipCompressor without being told, so compressed and uncompressed operations can be
+// mixed freely. It pays off for text-heavy files that differ a lot from their remote copy.
+func WithCompression(c Compressor) Option {
+	return func(o *options) {
+		o.compressor = c
+	}
+}
+
+// WithConcurrency makes Signatures and SignaturesFunc calculate the strong checksums of blocks across n workers,
+// reading blocks ahead while earlier ones are hashed. Signatures are still sent, or passed to fn, in order. Every
+// worker hashes with its own copy of the strong hash, made through its binary marshaling, which the hashes of
+// the standard library support; hashes that can't be copied are calculated by a single worker. SuggestWorkers
+// tells a reasonable n.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithChannelBuffer makes Signatures and Sync send over channels holding up to n results, so they run ahead of
+// their consumers and hand results over in batches, instead of switching goroutines for every block. Results
+// already buffered are still received once the context is cancelled, or the timeout runs out.
+func WithChannelBuffer(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			n = 0
+		}
+		o.channelBuffer = n
+	}
+}
+
+// WithBufferReuse makes Sync send literal data in pooled buffers, which consumers give back with
+// BlockOperation.Release once done with them, as Apply does. It spares an allocation per literal operation, but
+// requires consumers not to use the data of operations once released, nor to release applied operations.
+func WithBufferReuse() Option {
+	return func(o *options) {
+		o.bufferReuse = true
+	}
+}
@@ -0,0 +1,229 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"hash"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// hashCloner returns a function making copies of shash, one per worker, or nil if shash can't be copied. Hashes
+// are copied through their binary marshaling, as the hashes of the standard library support, into new values of
+// the same type. Copies are checked to hash like shash, which is reset in the process.
+func hashCloner(shash hash.Hash) func() hash.Hash {
+	m, ok := shash.(encoding.BinaryMarshaler)
+	t := reflect.TypeOf(shash)
+	if !ok || t.Kind() != reflect.Ptr {
+		return nil
+	}
+
+	shash.Reset()
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+
+	clone := func() hash.Hash {
+		h, ok := reflect.New(t.Elem()).Interface().(hash.Hash)
+		if !ok {
+			return nil
+		}
+		u, ok := h.(encoding.BinaryUnmarshaler)
+		if !ok || u.UnmarshalBinary(state) != nil {
+			return nil
+		}
+		return h
+	}
+
+	h := clone()
+	if h == nil {
+		return nil
+	}
+	h.Write([]byte(signaturesMagic))
+	shash.Write([]byte(signaturesMagic))
+	if !bytes.Equal(h.Sum(nil), shash.Sum(nil)) {
+		return nil
+	}
+	return clone
+}
+
+// signatureJob is a block read by parallelSignatures, waiting for its signature. Jobs, along with their buffers
+// unless they come from an allocator, are recycled once their signature is passed on.
+type signatureJob struct {
+	index   uint64
+	buffer  []byte
+	release func()
+	block   []byte
+	sig     BlockSignature
+	// done receives a value once sig is set.
+	done chan struct{}
+}
+
+// parallelSignatures works like signatures, hashing blocks across opt.concurrency workers, each with its own
+// copy of the strong hash. Blocks are read ahead, up to twice as many as there are workers, and fn is still
+// called with their signatures in order, from the calling goroutine.
+func parallelSignatures(ctx context.Context, r io.Reader, clone func() hash.Hash, opt *options, fn func(BlockSignature) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		readErr error
+		jobs    = make(chan *signatureJob)
+		queue   = make(chan *signatureJob, 2*opt.concurrency)
+		// One more job than queued and being read, for the one fn is called with.
+		free = make(chan *signatureJob, 2*opt.concurrency+2)
+	)
+	for i := 0; i < cap(free); i++ {
+		free <- &signatureJob{done: make(chan struct{}, 1)}
+	}
+
+	for i := 0; i < opt.concurrency; i++ {
+		shash := clone()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var sums strongSums
+			for j := range jobs {
+				j.sig = signature(shash, opt, &sums, j.index, j.block)
+				j.done <- struct{}{}
+			}
+		}()
+	}
+
+	// The reader queues blocks in order, then hands them out to the workers.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(queue)
+		defer close(jobs)
+
+		for index := opt.startIndex; ; index++ {
+			var j *signatureJob
+			select {
+			case j = <-free:
+			case <-ctx.Done():
+				return
+			}
+
+			if j.buffer == nil {
+				buffer, release, err := getBuffer(ctx, opt, opt.blockLen())
+				if err != nil {
+					readErr = err
+					free <- j
+					return
+				}
+				j.buffer, j.release = buffer, release
+			}
+			j.index, j.block, j.sig = index, nil, BlockSignature{}
+
+			// Short reads would shift block boundaries, see signatures.
+			n, err := io.ReadFull(r, j.buffer)
+			if err == io.EOF {
+				free <- j
+				return
+			}
+
+			// Jobs belong to the consumer once queued, so what is left to decide on is worked out beforehand.
+			failed, short := err != nil && err != io.ErrUnexpectedEOF, n < len(j.buffer)
+			if failed {
+				j.sig = BlockSignature{Index: index, Error: errors.Wrapf(err, "failed reading block")}
+				j.done <- struct{}{}
+			} else {
+				j.block = j.buffer[:n]
+			}
+
+			// The queue has room for every job but the ones being read or passed on.
+			queue <- j
+			if failed {
+				continue
+			}
+
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				// Queued, so left out by the consumer once done.
+				j.done <- struct{}{}
+				return
+			}
+
+			if short {
+				return
+			}
+		}
+	}()
+
+	// Waits for every goroutine and releases the buffers, so neither r nor buffers are touched past return.
+	defer func() {
+		cancel()
+		for j := range queue {
+			<-j.done
+			free <- j
+		}
+		wg.Wait()
+
+		close(free)
+		for j := range free {
+			if j.release != nil {
+				j.release()
+			}
+		}
+	}()
+
+	index, last := opt.startIndex, false
+	for j := range queue {
+		// Blocks left out once the context is done are marked done without signature, so cancellation is
+		// checked after waiting for them.
+		<-j.done
+		if err := ctx.Err(); err != nil {
+			free <- j
+			return err
+		}
+
+		err := fn(j.sig)
+		block := j.block
+		index = j.index + 1
+		// Buffers accounted for by an allocator are not held on to, or reading ahead could wait on them forever.
+		if opt.allocator != nil {
+			j.release()
+			j.buffer, j.release = nil, nil
+		}
+		free <- j
+		if err != nil {
+			return err
+		}
+
+		if block == nil {
+			continue
+		}
+
+		if len(block) < opt.blockLen() {
+			last = true
+			break
+		}
+
+		if err := signaturesCheckpoint(opt, index, false); err != nil {
+			return err
+		}
+	}
+
+	if !last {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	return signaturesCheckpoint(opt, index, true)
+}
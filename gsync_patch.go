@@ -0,0 +1,496 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Patch files hold a whole delta, self-contained and random-access, so it can be distributed and applied, or read
+// from, without channels. All integers are big-endian. A patch file is made of:
+//
+//	header   "GSYNCPAT", 8 bytes
+//	literals the data of all literal operations, back to back, in order
+//	index    one 24 bytes entry per operation, in order:
+//	         kind     1 byte, 0 for copies from the basis, 1 for literals
+//	         reserved 3 bytes, zero
+//	         length   uint32, bytes the operation produces
+//	         offset   int64, offset of the operation within the reconstructed file
+//	         source   uint64, index of the block copied, or offset of the literal data within the patch file
+//	checksum checksum of the reconstructed file, see BlockOperation.Checksum, up to 1024 bytes, possibly none
+//	footer   52 bytes:
+//	         version      uint32, 1
+//	         block size   uint32
+//	         basis size   int64, size of the file blocks are copied from
+//	         total size   int64, size of the reconstructed file
+//	         index offset int64, offset of the index within the patch file
+//	         entries      uint64, number of index entries
+//	         checksum     uint32, 0 for none, 1 for SHA-256, 2 for HMAC-SHA256, keyed as set with WithHashKey
+//	         magic        "GSYNCPAT", 8 bytes
+//
+// Entries are sorted by offset and cover the reconstructed file without gaps, so the operation producing any byte
+// of it can be found with a binary search. The checksum fills the gap between the index and the footer.
+const (
+	patchMagic     = "GSYNCPAT"
+	patchVersion   = 1
+	patchEntrySize = 24
+	patchFooterLen = 52
+)
+
+// Checksums of the reconstructed file patch files may hold, see BlockOperation.Checksum.
+const (
+	patchNoChecksum uint32 = iota
+	patchSHA256
+	patchHMACSHA256
+)
+
+const (
+	patchCopy uint8 = iota
+	patchLiteral
+)
+
+// ErrInvalidPatch is returned when reading malformed or truncated patch files.
+var ErrInvalidPatch = errors.New("gsync: invalid patch file")
+
+// patchEntry is an index entry of a patch file.
+type patchEntry struct {
+	kind   uint8
+	length uint32
+	offset int64
+	source uint64
+}
+
+// WritePatch writes the delta in ops to w as a patch file, see OpenPatchFile. basisSize is the size of the file
+// blocks are copied from, which the patch file needs to tell how many bytes each copy produces. Operations
+// copying from a dictionary can't be stored in patch files, and compressed literals are stored decompressed.
+// Like Apply, WritePatch fails with ErrIncompleteDelta if ops end before the final operation. Options tell the
+// block size, as WithBlockSize does, the Compressor literals were compressed with, as WithCompression does, and
+// whether the checksum of the final operation is keyed, as WithHashKey does.
+func WritePatch(ctx context.Context, w io.Writer, basisSize int64, ops <-chan BlockOperation, opts ...Option) error {
+	bw := bufio.NewWriter(w)
+	opt := newOptions(opts)
+	bs := int64(opt.blockLen())
+	scratch := make([]byte, opt.literalLen())
+
+	var (
+		entries  []patchEntry
+		pos      = int64(len(patchMagic))
+		size     int64
+		final    bool
+		checksum []byte
+	)
+
+	if _, err := bw.WriteString(patchMagic); err != nil {
+		return errors.Wrapf(err, "failed writing patch file")
+	}
+
+loop:
+	for {
+		var o BlockOperation
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "failed writing patch file")
+		case op, ok := <-ops:
+			if !ok {
+				break loop
+			}
+			o = op
+		}
+
+		switch {
+		case o.Error != nil:
+			return errors.Wrapf(o.Error, "failed writing patch file")
+		case o.Final:
+			if o.TotalSize != size {
+				return errors.Wrapf(ErrIncompleteDelta, "expected %d bytes, got %d", o.TotalSize, size)
+			}
+			if len(o.Checksum) > maxWireStrongLen {
+				return errors.Errorf("gsync: checksum of %d bytes too large for patch files", len(o.Checksum))
+			}
+			checksum = o.Checksum
+			final = true
+			break loop
+		case len(o.Data) > 0:
+			data, err := opt.literal(o, scratch)
+			if err != nil {
+				return err
+			}
+			if _, err := bw.Write(data); err != nil {
+				return errors.Wrapf(err, "failed writing patch file")
+			}
+			entries = append(entries, patchEntry{kind: patchLiteral, length: uint32(len(data)), offset: size, source: uint64(pos)})
+			pos += int64(len(data))
+			size += int64(len(data))
+		case o.Dictionary != 0:
+			return errors.Errorf("gsync: patch files can't copy blocks from dictionaries")
+		default:
+			if o.Index >= uint64((basisSize+bs-1)/bs) {
+				return errors.Wrapf(ErrInvalidDelta, "block %d is past the end of the basis", o.Index)
+			}
+
+			length := basisSize - int64(o.Index)*bs
+			if length > bs {
+				length = bs
+			}
+			entries = append(entries, patchEntry{kind: patchCopy, length: uint32(length), offset: size, source: o.Index})
+			size += length
+		}
+	}
+
+	if !final {
+		return ErrIncompleteDelta
+	}
+
+	buf := make([]byte, patchEntrySize)
+	for _, e := range entries {
+		buf[0], buf[1], buf[2], buf[3] = e.kind, 0, 0, 0
+		binary.BigEndian.PutUint32(buf[4:], e.length)
+		binary.BigEndian.PutUint64(buf[8:], uint64(e.offset))
+		binary.BigEndian.PutUint64(buf[16:], e.source)
+		if _, err := bw.Write(buf); err != nil {
+			return errors.Wrapf(err, "failed writing patch file")
+		}
+	}
+
+	if _, err := bw.Write(checksum); err != nil {
+		return errors.Wrapf(err, "failed writing patch file")
+	}
+
+	footer := make([]byte, patchFooterLen)
+	binary.BigEndian.PutUint32(footer[0:], patchVersion)
+	binary.BigEndian.PutUint32(footer[4:], uint32(bs))
+	binary.BigEndian.PutUint64(footer[8:], uint64(basisSize))
+	binary.BigEndian.PutUint64(footer[16:], uint64(size))
+	binary.BigEndian.PutUint64(footer[24:], uint64(pos))
+	binary.BigEndian.PutUint64(footer[32:], uint64(len(entries)))
+	switch {
+	case len(checksum) == 0:
+		binary.BigEndian.PutUint32(footer[40:], patchNoChecksum)
+	case len(opt.hashKey) > 0:
+		binary.BigEndian.PutUint32(footer[40:], patchHMACSHA256)
+	default:
+		binary.BigEndian.PutUint32(footer[40:], patchSHA256)
+	}
+	copy(footer[44:], patchMagic)
+	if _, err := bw.Write(footer); err != nil {
+		return errors.Wrapf(err, "failed writing patch file")
+	}
+
+	if err := bw.Flush(); err != nil {
+		return errors.Wrapf(err, "failed writing patch file")
+	}
+	return nil
+}
+
+// Patch returns the patch file reconstructing source from basis, see WritePatch. Along with Unpatch, it covers
+// the whole sync process for data held in memory. Blocks are hashed with SHA-256, the only strong hash Unpatch
+// needs not be told about. Options apply to calculating signatures and syncing.
+func Patch(ctx context.Context, basis, source []byte, opts ...Option) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sigs, err := Signatures(ctx, bytes.NewReader(basis), nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := LookUpTable(ctx, sigs, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := new(bytes.Buffer)
+	if err := WritePatch(ctx, delta, int64(len(basis)), ops, opts...); err != nil {
+		return nil, err
+	}
+	return delta.Bytes(), nil
+}
+
+// Unpatch reconstructs the file the patch file delta, as returned by Patch, was made for, from basis. Patch files
+// record everything needed to apply them, block size included, and whether the checksum of the reconstructed file
+// is keyed: the key given to Patch with WithHashKey must be given again, no other options need to match. Patches
+// made with a key fail without one, and the other way around. Options apply to Apply.
+func Unpatch(ctx context.Context, basis, delta []byte, opts ...Option) ([]byte, error) {
+	pf, err := OpenPatchFile(bytes.NewReader(delta), int64(len(delta)))
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyed := len(newOptions(opts).hashKey) > 0; {
+	case pf.checksumKind == patchHMACSHA256 && !keyed:
+		return nil, errors.New("gsync: patch checksum is keyed, a hash key is required")
+	case pf.checksumKind == patchSHA256 && keyed:
+		return nil, errors.New("gsync: patch checksum is not keyed, no hash key expected")
+	}
+
+	if pf.BasisSize() != int64(len(basis)) {
+		return nil, errors.Wrapf(ErrInvalidPatch, "patch is for a basis of %d bytes, got %d", pf.BasisSize(), len(basis))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	source := bytes.NewBuffer(make([]byte, 0, pf.Size()))
+	opts = append(opts[:len(opts):len(opts)], WithBlockSize(pf.BlockSize()))
+	if err := Apply(ctx, source, bytes.NewReader(basis), pf.Operations(ctx), opts...); err != nil {
+		return nil, err
+	}
+	return source.Bytes(), nil
+}
+
+// PatchFile gives access to a patch file written by WritePatch.
+type PatchFile struct {
+	r         io.ReaderAt
+	blockSize int64
+	basisSize int64
+	size      int64
+	checksum  []byte
+	// checksumKind tells how checksum was calculated, keyed or not.
+	checksumKind uint32
+	entries      []patchEntry
+}
+
+// OpenPatchFile reads the index of the patch file of the given size held by r, checking it is well-formed.
+func OpenPatchFile(r io.ReaderAt, size int64) (*PatchFile, error) {
+	if size < int64(len(patchMagic))+patchFooterLen {
+		return nil, ErrInvalidPatch
+	}
+
+	header := make([]byte, len(patchMagic))
+	if err := readFullAt(r, header, 0); err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, patchFooterLen)
+	if err := readFullAt(r, footer, size-patchFooterLen); err != nil {
+		return nil, err
+	}
+
+	if string(header) != patchMagic || string(footer[44:]) != patchMagic {
+		return nil, ErrInvalidPatch
+	}
+
+	if v := binary.BigEndian.Uint32(footer[0:]); v != patchVersion {
+		return nil, errors.Wrapf(ErrInvalidPatch, "unsupported version %d", v)
+	}
+
+	bs := int64(binary.BigEndian.Uint32(footer[4:]))
+	if bs == 0 || bs > math.MaxInt32 {
+		return nil, errors.Wrapf(ErrInvalidPatch, "unsupported block size %d", bs)
+	}
+
+	pf := &PatchFile{
+		r:         r,
+		blockSize: bs,
+		basisSize: int64(binary.BigEndian.Uint64(footer[8:])),
+		size:      int64(binary.BigEndian.Uint64(footer[16:])),
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[24:]))
+	count := binary.BigEndian.Uint64(footer[32:])
+
+	if pf.basisSize < 0 || pf.size < 0 || indexOffset < int64(len(patchMagic)) || indexOffset > size ||
+		count > uint64(size)/patchEntrySize {
+		return nil, ErrInvalidPatch
+	}
+
+	pf.checksumKind = binary.BigEndian.Uint32(footer[40:])
+	checksumLen := size - patchFooterLen - (indexOffset + int64(count)*patchEntrySize)
+	if checksumLen < 0 || checksumLen > maxWireStrongLen || pf.checksumKind > patchHMACSHA256 ||
+		(pf.checksumKind == patchNoChecksum) != (checksumLen == 0) {
+		return nil, ErrInvalidPatch
+	}
+	if checksumLen > 0 {
+		pf.checksum = make([]byte, checksumLen)
+		if err := readFullAt(r, pf.checksum, size-patchFooterLen-checksumLen); err != nil {
+			return nil, err
+		}
+	}
+
+	index := make([]byte, count*patchEntrySize)
+	if err := readFullAt(r, index, indexOffset); err != nil {
+		return nil, err
+	}
+
+	pf.entries = make([]patchEntry, count)
+	var offset int64
+	for i := range pf.entries {
+		b := index[i*patchEntrySize:]
+		e := patchEntry{
+			kind:   b[0],
+			length: binary.BigEndian.Uint32(b[4:]),
+			offset: int64(binary.BigEndian.Uint64(b[8:])),
+			source: binary.BigEndian.Uint64(b[16:]),
+		}
+
+		if e.offset != offset || e.length == 0 || int64(e.length) > bs && e.kind == patchCopy {
+			return nil, ErrInvalidPatch
+		}
+
+		switch e.kind {
+		case patchCopy:
+			// Copies produce the whole block, which Operations and Reader must agree on.
+			if e.source > uint64(pf.basisSize/bs) {
+				return nil, ErrInvalidPatch
+			}
+			length := pf.basisSize - int64(e.source)*bs
+			if length > bs {
+				length = bs
+			}
+			if int64(e.length) != length {
+				return nil, ErrInvalidPatch
+			}
+		case patchLiteral:
+			if e.source < uint64(len(patchMagic)) || e.source > uint64(indexOffset) ||
+				e.source+uint64(e.length) > uint64(indexOffset) {
+				return nil, ErrInvalidPatch
+			}
+		default:
+			return nil, ErrInvalidPatch
+		}
+
+		pf.entries[i] = e
+		offset += int64(e.length)
+	}
+
+	if offset != pf.size {
+		return nil, ErrInvalidPatch
+	}
+	return pf, nil
+}
+
+// Size returns the size of the file the patch reconstructs.
+func (pf *PatchFile) Size() int64 {
+	return pf.size
+}
+
+// BlockSize returns the size of the blocks the patch copies, which Apply must be given with WithBlockSize.
+func (pf *PatchFile) BlockSize() int {
+	return int(pf.blockSize)
+}
+
+// Checksum returns the checksum of the file the patch reconstructs, as sent by Sync with the final operation, or
+// nil if the patch file holds none.
+func (pf *PatchFile) Checksum() []byte {
+	return pf.checksum
+}
+
+// BasisSize returns the size of the file the patch copies blocks from.
+func (pf *PatchFile) BasisSize() int64 {
+	return pf.basisSize
+}
+
+// Operations returns the delta stored in the patch file, to be passed to Apply along with the basis. Literal data
+// is read from the patch file as operations are sent, and the final operation carries the checksum, if any, so
+// Apply verifies the reconstructed file. Like Sync, Operations closes the channel when done or
+// when the context is cancelled.
+func (pf *PatchFile) Operations(ctx context.Context) <-chan BlockOperation {
+	o := make(chan BlockOperation)
+
+	go func() {
+		defer close(o)
+
+		send := func(op BlockOperation) bool {
+			select {
+			case o <- op:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, e := range pf.entries {
+			op := BlockOperation{Index: e.source}
+			if e.kind == patchLiteral {
+				op = BlockOperation{Data: make([]byte, e.length)}
+				if err := readFullAt(pf.r, op.Data, int64(e.source)); err != nil {
+					send(BlockOperation{Error: err})
+					return
+				}
+			}
+
+			if !send(op) {
+				return
+			}
+		}
+		send(BlockOperation{Final: true, TotalSize: pf.size, Checksum: pf.checksum})
+	}()
+
+	return o
+}
+
+// Reader returns a reader of the file the patch reconstructs, reading its data from the patch file and from
+// basis as needed, without applying the patch.
+func (pf *PatchFile) Reader(basis io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(&patchReaderAt{pf: pf, basis: basis}, 0, pf.size)
+}
+
+// patchReaderAt reads the file a patch reconstructs.
+type patchReaderAt struct {
+	pf    *PatchFile
+	basis io.ReaderAt
+}
+
+// ReadAt implements io.ReaderAt.
+func (p *patchReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	entries := p.pf.entries
+
+	// The first entry ending past off produces the byte at off.
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].offset+int64(entries[i].length) > off
+	})
+
+	var n int
+	for ; n < len(b) && i < len(entries); i++ {
+		e := entries[i]
+
+		skip := off + int64(n) - e.offset
+		chunk := b[n:]
+		if rest := int64(e.length) - skip; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+
+		var err error
+		if e.kind == patchLiteral {
+			err = readFullAt(p.pf.r, chunk, int64(e.source)+skip)
+		} else {
+			err = readFullAt(p.basis, chunk, int64(e.source)*p.pf.blockSize+skip)
+		}
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readFullAt reads exactly len(b) bytes of r at off, treating a short read as a truncated patch file or basis.
+func readFullAt(r io.ReaderAt, b []byte, off int64) error {
+	n, err := r.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return errors.Wrapf(err, "failed reading patch file")
+}
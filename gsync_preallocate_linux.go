@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package gsync
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, allocating space without changing the size of the file.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk space for f, from its current position, failing early when there is
+// not enough. Filesystems not supporting fallocate, and files that can't seek, are left alone.
+func preallocate(f *os.File, size int64) error {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+
+	for {
+		err = syscall.Fallocate(int(f.Fd()), fallocKeepSize, pos, size)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
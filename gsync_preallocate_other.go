@@ -0,0 +1,15 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package gsync
+
+import "os"
+
+// preallocate does nothing, fallocate is only supported on Linux.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
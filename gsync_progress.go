@@ -0,0 +1,38 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import "time"
+
+// progressInterval is the minimum time between two progress reports, see WithProgress.
+const progressInterval = 100 * time.Millisecond
+
+// progress reports the statistics of a call every progressInterval, to the function set with WithProgress.
+type progress struct {
+	fn    func(Stats)
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(opt *options) *progress {
+	now := time.Now()
+	return &progress{fn: opt.progress, start: now, last: now}
+}
+
+// update sets the elapsed time of s, and reports s if it was not for progressInterval, or if the call is done.
+func (p *progress) update(s *Stats, done bool) {
+	if p.fn == nil && !done {
+		return
+	}
+
+	now := time.Now()
+	s.Elapsed = now.Sub(p.start)
+	if p.fn == nil || (!done && now.Sub(p.last) < progressInterval) {
+		return
+	}
+
+	p.last = now
+	p.fn(*s)
+}
@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"context"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// WriteSignature, WriteDelta and ApplyDelta work like rdiff: the signature file of the old copy of a file is
+// shipped where the new copy is, to write a delta file from, later applied to the old copy to get the new one.
+// Signature files are signature streams, see EncodeSignatures, whose header holds the block size, even
+// for empty files. Delta files are made of:
+//
+//	header     "GSDT", 2, block size, as a varint, the version being the one of operation streams
+//	operations an operation stream, see EncodeOperations, ending with the final operation
+//
+// Neither records the strong hash used. Writing a delta with a hash other than the one the signature file was
+// written with finds no matches, and makes for a delta as large as the new file.
+const deltaMagic = "GSDT"
+
+// WriteSignature writes the signature file of the old copy of a file, read from r, to w. As with Signatures,
+// shash defaults to SHA-256.
+func WriteSignature(ctx context.Context, r io.Reader, shash hash.Hash, w io.Writer, opts ...Option) error {
+	ww := &wireWriter{w: bufio.NewWriter(w)}
+	ww.signaturesHeader(newOptions(opts).blockLen())
+
+	err := SignaturesFunc(ctx, r, shash, func(s BlockSignature) error {
+		if s.Error != nil {
+			return errors.Wrapf(s.Error, "failed reading block %d", s.Index)
+		}
+
+		ww.signature(s)
+		return ww.err
+	}, opts...)
+	if err != nil {
+		return errors.Wrapf(err, "failed writing signature file")
+	}
+
+	ww.write([]byte{wireEnd})
+	return ww.flush()
+}
+
+// WriteDelta writes the delta file turning the file whose signature file is read from sig into the file read
+// from r, to w. shash has to be the strong hash the signature file was written with. The block size is the one
+// of the signature file.
+func WriteDelta(ctx context.Context, r io.ReaderAt, shash hash.Hash, sig io.Reader, w io.Writer, opts ...Option) error {
+	if sig == nil {
+		return errors.New("gsync: signature reader required")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	br := bufio.NewReader(sig)
+	size, err := readSignaturesHeader(br)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading signature file")
+	}
+	if size == 0 {
+		return errors.Wrapf(ErrInvalidEncoding, "signature file has no block size")
+	}
+
+	var decodeErr error
+	sigs := make(chan BlockSignature)
+	go func() {
+		defer close(sigs)
+		decodeErr = decodeSignatureRecords(br, size, func(s BlockSignature) bool {
+			select {
+			case sigs <- s:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	remote, err := LookUpTable(ctx, sigs, opts...)
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed reading signature file")
+	}
+
+	ops, err := Sync(ctx, r, shash, remote, append(opts[:len(opts):len(opts)], WithBlockSize(size))...)
+	if err != nil {
+		return err
+	}
+
+	ww := &wireWriter{w: bufio.NewWriter(w)}
+	ww.header(deltaMagic)
+	ww.uvarint(uint64(size))
+	ww.header(operationsMagic)
+
+	for o := range ops {
+		if o.Error != nil {
+			return errors.Wrapf(o.Error, "failed writing delta file")
+		}
+
+		ww.operation(o)
+		if o.Final {
+			return ww.flush()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "failed writing delta file")
+	}
+	return errors.Wrapf(ErrIncompleteDelta, "failed writing delta file")
+}
+
+// ApplyDelta applies the delta file read from delta to base, the old copy of the file, writing the new copy to
+// dst. It takes the same options as Apply, except for the block size, which is the one of the delta file. It is
+// rdiff's patch step, named apart from Patch, which makes in-memory patch files.
+func ApplyDelta(ctx context.Context, base io.ReaderAt, delta io.Reader, dst io.Writer, opts ...Option) error {
+	if delta == nil {
+		return errors.New("gsync: reader required")
+	}
+
+	br := bufio.NewReader(delta)
+	if err := readHeader(br, deltaMagic); err != nil {
+		return errors.Wrapf(err, "failed reading delta file")
+	}
+
+	size, err := readUvarint(br)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading delta file")
+	}
+	if size == 0 || size > maxWireDataLen {
+		return errors.Wrapf(ErrInvalidEncoding, "invalid block size %d", size)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ops, err := DecodeOperations(ctx, br)
+	if err != nil {
+		return err
+	}
+	return Apply(ctx, dst, base, ops, append(opts[:len(opts):len(opts)], WithBlockSize(int(size)))...)
+}
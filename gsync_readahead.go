@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"context"
+	"io"
+)
+
+// readAheadReaderAt batches reads of r into windows of several blocks and fetches the window following the one
+// being read in the background, so mostly sequential reads from high-latency sources, like the copies Apply
+// makes from the cached file, don't each wait for a round-trip. It is not safe for concurrent use.
+type readAheadReaderAt struct {
+	ctx  context.Context
+	r    io.ReaderAt
+	size int
+
+	cur  window
+	next *fetch
+	// spare is the buffer of the last window served, reused by the next fetch.
+	spare []byte
+}
+
+// window is a range of r read in a single call, starting at off. eof tells the range reaches the end of r,
+// in which case no window is fetched past it.
+type window struct {
+	off  int64
+	data []byte
+	eof  bool
+	err  error
+}
+
+// fetch is a window being read in the background. done is closed once it is ready.
+type fetch struct {
+	w    window
+	done chan struct{}
+}
+
+// newReadAheadReaderAt returns a reader of r fetching windows of the given number of blocks of size bytes.
+func newReadAheadReaderAt(ctx context.Context, r io.ReaderAt, blocks, size int) *readAheadReaderAt {
+	return &readAheadReaderAt{ctx: ctx, r: r, size: blocks * size}
+}
+
+// read reads the window starting at off, into buf if it is large enough.
+func (ra *readAheadReaderAt) read(buf []byte, off int64) window {
+	if cap(buf) < ra.size {
+		buf = make([]byte, ra.size)
+	}
+
+	n, err := ra.r.ReadAt(buf[:ra.size], off)
+	w := window{off: off, data: buf[:n]}
+	switch {
+	case err == io.EOF:
+		w.eof = true
+	case err != nil:
+		w.err = err
+	case n < ra.size:
+		// Well-behaved readers never return short reads without error, but just in case.
+		w.eof = true
+	}
+	return w
+}
+
+// contains tells whether w holds the whole range of length n at off, or as much of it as r has.
+func (w window) contains(off int64, n int) bool {
+	if w.data == nil || off < w.off {
+		return false
+	}
+	end := w.off + int64(len(w.data))
+	return off+int64(n) <= end || (w.eof && w.err == nil)
+}
+
+// ReadAt implements io.ReaderAt.
+func (ra *readAheadReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if !ra.cur.contains(off, len(p)) && ra.next != nil {
+		select {
+		case <-ra.next.done:
+		case <-ra.ctx.Done():
+			return 0, ra.ctx.Err()
+		}
+
+		ra.spare, ra.cur, ra.next = ra.cur.data, ra.next.w, nil
+	}
+
+	if !ra.cur.contains(off, len(p)) {
+		ra.spare, ra.cur = ra.cur.data, ra.read(ra.spare, off)
+	}
+
+	if ra.cur.err != nil {
+		err := ra.cur.err
+		ra.cur = window{}
+		return 0, err
+	}
+
+	var n int
+	if start := off - ra.cur.off; start < int64(len(ra.cur.data)) {
+		n = copy(p, ra.cur.data[start:])
+	}
+
+	// Fetches what comes next, unless the end of r was reached already.
+	if ra.next == nil && !ra.cur.eof {
+		f := &fetch{done: make(chan struct{})}
+		buf, off := ra.spare, ra.cur.off+int64(len(ra.cur.data))
+		ra.spare = nil
+
+		go func() {
+			defer close(f.done)
+			f.w = ra.read(buf, off)
+		}()
+		ra.next = f
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// close waits for the background fetch, if any, so r is not read from anymore once it returns, unless the
+// context is cancelled first.
+func (ra *readAheadReaderAt) close() {
+	if ra.next == nil {
+		return
+	}
+
+	select {
+	case <-ra.next.done:
+	case <-ra.ctx.Done():
+	}
+	ra.next = nil
+}
@@ -5,7 +5,10 @@
 package gsync
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"hash"
 	"io"
@@ -18,115 +21,701 @@ import (
 // returning channel, closing it when done reading or when the context is cancelled.
 // This function does not block and returns immediately. The caller must make sure the concrete
 // reader instance is not nil or this function will panic.
-func Signatures(ctx context.Context, r io.Reader, shash hash.Hash) (<-chan BlockSignature, error) {
-	var index uint64
-	c := make(chan BlockSignature)
-
-	bfp := bufferPool.Get().(*[]byte)
-	buffer := *bfp
-	defer bufferPool.Put(bfp)
+//
+// Block indexes start at zero, unless WithStartIndex is used to sign only the tail of a file.
+func Signatures(ctx context.Context, r io.Reader, shash hash.Hash, opts ...Option) (<-chan BlockSignature, error) {
+	return startSignatures(ctx, r, shash, opts, nil)
+}
 
+// startSignatures holds the logic of Signatures, calling done, if not nil, right before closing the returned channel.
+func startSignatures(ctx context.Context, r io.Reader, shash hash.Hash, opts []Option, done func()) (<-chan BlockSignature, error) {
 	if r == nil {
-		close(c)
 		return nil, errors.New("gsync: reader required")
 	}
 
+	opt := newOptions(opts)
+	if err := opt.validateStart(); err != nil {
+		return nil, err
+	}
+
 	if shash == nil {
 		shash = sha256.New()
 	}
 
+	tctx, cancel := opt.withTimeout(ctx)
+	r, release := bufferReads(tctx, r, opt)
+
+	if opt.decoder != nil {
+		var err error
+		if r, err = opt.decoder(r); err != nil {
+			release()
+			cancel()
+			return nil, errors.Wrapf(err, "failed decoding data")
+		}
+	}
+
+	c := make(chan BlockSignature, opt.channelBuffer)
+
 	go func() {
 		defer close(c)
+		defer cancel()
+		defer release()
+		if done != nil {
+			defer done()
+		}
 
-		for {
-			// Allow for cancellation
+		err := signatures(tctx, r, shash, opt, func(s BlockSignature) error {
+			select {
+			case c <- s:
+				return nil
+			case <-tctx.Done():
+				return tctx.Err()
+			}
+		})
+		if err = timedOut(ctx, tctx, err); err != nil {
+			// Nobody may be listening anymore if the context was cancelled.
 			select {
+			case c <- BlockSignature{Error: err}:
 			case <-ctx.Done():
-				c <- BlockSignature{
-					Index: index,
-					Error: ctx.Err(),
-				}
-				return
-			default:
-				// break out of the select block and continue reading
-				break
 			}
+		}
+	}()
 
-			n, err := r.Read(buffer)
-			if err == io.EOF {
-				break
-			}
+	return c, nil
+}
 
-			if err != nil {
-				c <- BlockSignature{
-					Index: index,
-					Error: errors.Wrapf(err, "failed reading block"),
-				}
-				index++
-				// let the caller decide whether to interrupt the process or not.
-				continue
-			}
+// SignaturesFunc works like Signatures but synchronously calls fn with every block signature instead of sending
+// them over a channel, sparing synchronous consumers the goroutine and channel overhead. Signatures reporting
+// read errors are passed to fn as well. Returning an error from fn stops the scan and SignaturesFunc returns it.
+func SignaturesFunc(ctx context.Context, r io.Reader, shash hash.Hash, fn func(BlockSignature) error, opts ...Option) error {
+	if r == nil {
+		return errors.New("gsync: reader required")
+	}
 
-			block := buffer[:n]
-			shash.Reset()
-			shash.Write(block)
-			strong := shash.Sum(nil)
-			_, _, rhash := rollingHash(block)
+	opt := newOptions(opts)
+	if err := opt.validateStart(); err != nil {
+		return err
+	}
 
-			c <- BlockSignature{
-				Index:  index,
-				Weak:   rhash,
-				Strong: strong,
-			}
-			index++
+	if shash == nil {
+		shash = sha256.New()
+	}
+
+	tctx, cancel := opt.withTimeout(ctx)
+	defer cancel()
+
+	r, release := bufferReads(tctx, r, opt)
+	defer release()
+
+	if opt.decoder != nil {
+		var err error
+		if r, err = opt.decoder(r); err != nil {
+			return errors.Wrapf(err, "failed decoding data")
 		}
-	}()
+	}
 
-	return c, nil
+	return timedOut(ctx, tctx, signatures(tctx, r, shash, opt, fn))
 }
 
-// Apply reconstructs a file given a set of operations. The caller must close the ops channel or the context when done or there will be a deadlock.
-func Apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan BlockOperation) error {
-	bfp := bufferPool.Get().(*[]byte)
-	buffer := *bfp
-	defer bufferPool.Put(bfp)
+// signatures holds the scanning logic shared by Signatures and SignaturesFunc. It reads whole blocks from r,
+// numbering them from the start index, and calls fn with their signatures.
+func signatures(ctx context.Context, r io.Reader, shash hash.Hash, opt *options, fn func(BlockSignature) error) error {
+	if opt.concurrency > 1 {
+		if clone := hashCloner(shash); clone != nil {
+			return parallelSignatures(ctx, r, clone, opt, fn)
+		}
+	}
+
+	var (
+		index = opt.startIndex
+		sums  strongSums
+	)
+
+	buffer, release, err := getBuffer(ctx, opt, opt.blockLen())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	checkpoint := func(force bool) error {
+		return signaturesCheckpoint(opt, index, force)
+	}
 
-	for o := range ops {
-		// Allows for cancellation.
+	for {
+		// Allow for cancellation
 		select {
 		case <-ctx.Done():
-			return errors.Wrapf(ctx.Err(), "failed applying block operations")
+			return ctx.Err()
 		default:
-			// break out of the select block and continue reading ops
+			// break out of the select block and continue reading
+			break
+		}
+
+		// Short reads would shift block boundaries away from the offsets Apply copies blocks from,
+		// so we make sure to always read whole blocks. Only the last one can be shorter.
+		n, err := io.ReadFull(r, buffer)
+		if err == io.EOF {
+			return checkpoint(true)
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			err = fn(BlockSignature{
+				Index: index,
+				Error: errors.Wrapf(err, "failed reading block"),
+			})
+			if err != nil {
+				return err
+			}
+			index++
+			// let the caller decide whether to interrupt the process or not.
+			continue
+		}
+
+		if err := fn(signature(shash, opt, &sums, index, buffer[:n])); err != nil {
+			return err
+		}
+		index++
+
+		if n < len(buffer) {
+			return checkpoint(true)
+		}
+
+		if err := checkpoint(false); err != nil {
+			return err
+		}
+	}
+}
+
+// signaturesCheckpoint records index, the position of the next block, every opt.checkpointEvery blocks or when forced.
+func signaturesCheckpoint(opt *options, index uint64, force bool) error {
+	if opt.checkpoint == nil {
+		return nil
+	}
+
+	if !force && (index-opt.startIndex)%opt.checkpointEvery != 0 {
+		return nil
+	}
+	return writeCheckpoint(opt.checkpoint, index, opt.blockLen())
+}
+
+// signature calculates the weak and strong checksums of a block, keying them, or salting the strong one with
+// the block index, if asked to.
+func signature(shash hash.Hash, opt *options, sums *strongSums, index uint64, block []byte) BlockSignature {
+	_, _, rhash := opt.weak(block)
+
+	return BlockSignature{
+		Index:     index,
+		Weak:      rhash,
+		Strong:    sums.next(shash, opt, index, block),
+		BlockSize: opt.blockLen(),
+	}
+}
+
+// SignatureBuilder calculates block signatures incrementally from the data fed to it, so the signatures of
+// a file can be kept up to date while the file is being written, without reading it back.
+// A SignatureBuilder is not safe for concurrent use.
+type SignatureBuilder struct {
+	shash   hash.Hash
+	opt     *options
+	sums    strongSums
+	size    int
+	index   uint64
+	pending []byte
+}
+
+// NewSignatureBuilder returns a SignatureBuilder using shash as strong hash, or SHA-256 if shash is nil.
+// Options affecting signatures, like WithIndexSalt or WithBlockSize, work as they do for Signatures.
+func NewSignatureBuilder(shash hash.Hash, opts ...Option) *SignatureBuilder {
+	if shash == nil {
+		shash = sha256.New()
+	}
+
+	opt := newOptions(opts)
+	return &SignatureBuilder{
+		shash:   shash,
+		opt:     opt,
+		size:    opt.blockLen(),
+		pending: make([]byte, 0, opt.blockLen()),
+	}
+}
+
+// Append feeds data to the builder and returns the signatures of the blocks it completed, if any.
+// Data does not need to be aligned to block boundaries, partial blocks are buffered until
+// enough data arrives.
+func (b *SignatureBuilder) Append(data []byte) []BlockSignature {
+	var sigs []BlockSignature
+	for len(data) > 0 {
+		// Hash straight from data when there is nothing buffered.
+		if len(b.pending) == 0 && len(data) >= b.size {
+			sigs = append(sigs, signature(b.shash, b.opt, &b.sums, b.index, data[:b.size]))
+			b.index++
+			data = data[b.size:]
+			continue
+		}
+
+		n := b.size - len(b.pending)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		b.pending = append(b.pending, data[:n]...)
+		data = data[n:]
+
+		if len(b.pending) == b.size {
+			sigs = append(sigs, signature(b.shash, b.opt, &b.sums, b.index, b.pending))
+			b.index++
+			b.pending = b.pending[:0]
+		}
+	}
+	return sigs
+}
+
+// Flush returns the signature of the trailing partial block, reporting false if there is none.
+// The partial block is kept, so data appended afterwards keeps filling it and Append eventually
+// returns its final signature, under the same index.
+func (b *SignatureBuilder) Flush() (BlockSignature, bool) {
+	if len(b.pending) == 0 {
+		return BlockSignature{}, false
+	}
+	return signature(b.shash, b.opt, &b.sums, b.index, b.pending), true
+}
+
+// Apply reconstructs a file given a set of operations. The caller must close the ops channel or the context when done or there will be a deadlock.
+//
+// Apply stops reading operations as soon as the context is cancelled or an error occurs. If ops comes from
+// Sync and shares its context, cancelling is enough for Sync to exit. Otherwise, the caller is responsible
+// for draining ops, with Drain for instance, so its producer is not left blocked.
+//
+// cache may be nil when there is no previous copy of the file, in which case Apply fails with ErrNoBasis
+// if asked to copy a block from it.
+//
+// Operations must end with a final one, as sent by Sync, or Apply fails with ErrIncompleteDelta, since the
+// reconstructed file would be missing data.
+//
+// Once all operations are applied, Apply flushes dst if it implements Flush() error, as bufio.Writer
+// and most compressors do, and then commits it to stable storage if it implements Sync() error, as os.File does.
+// If dst implements io.Seeker and Truncate(int64) error, as os.File does as well, Apply truncates it right after
+// the last byte written, so applying in place over a larger copy of the file leaves none of its old data behind.
+// Files other than regular ones, as pipes and terminals, are neither synced nor truncated.
+func Apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	opt := newOptions(opts)
+
+	tctx, cancel := opt.withTimeout(ctx)
+	defer cancel()
+
+	return timedOut(ctx, tctx, apply(tctx, dst, cache, ops, opt, nil))
+}
+
+// apply holds the logic of Apply, running under the context derived for the call. res, if not nil, records
+// checkpoints and resumes from one, see ApplyAt.
+func apply(ctx context.Context, dst io.Writer, cache io.ReaderAt, ops <-chan BlockOperation, opt *options, res *applyResume) error {
+	var (
+		written, size int64
+		applied       uint64
+		final         bool
+		stats         Stats
+		prog          = newProgress(opt)
+		sum           = opt.fileHash()
+	)
+
+	// A nil *os.File would only panic when read from.
+	if f, ok := cache.(*os.File); ok && f == nil {
+		cache = nil
+	}
+
+	if cache != nil && opt.readAhead > 0 {
+		ra := newReadAheadReaderAt(ctx, cache, opt.readAhead, opt.blockLen())
+		defer ra.close()
+		cache = ra
+	}
+
+	if f, ok := dst.(*os.File); ok && f != nil && opt.preallocate > 0 {
+		if err := preallocate(f, opt.preallocate); err != nil {
+			return errors.Wrapf(err, "failed preallocating destination")
+		}
+	}
+
+	w := dst
+	if cache != nil && opt.decoder != nil {
+		cache = &decodedReaderAt{r: cache, dec: opt.decoder}
+	}
+
+	var enc io.WriteCloser
+	if opt.encoder != nil {
+		var err error
+		if enc, err = opt.encoder(dst); err != nil {
+			return errors.Wrapf(err, "failed encoding destination")
+		}
+		w = enc
+	}
+
+	var batch *bufio.Writer
+	if opt.writeBatchSize > 0 {
+		batch = bufio.NewWriterSize(w, opt.writeBatchSize)
+		w = batch
+	}
+
+	buffer, release, err := getBuffer(ctx, opt, opt.blockLen())
+	if err != nil {
+		return err
+	}
+	defer release()
+	var unpacked []byte
+
+	in := &opReader{ops: ops, plan: opt.accessPlan}
+
+	for {
+		o, ok, err := in.next(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
 			break
 		}
 
+		if opt.logger != nil {
+			logOperation(opt.logger, "apply", o)
+		}
+
 		if o.Error != nil {
 			return errors.Wrapf(o.Error, "failed applying operation")
 		}
 
+		if o.Final {
+			if o.TotalSize != size {
+				return errors.Wrapf(ErrIncompleteDelta, "expected %d bytes, got %d", o.TotalSize, size)
+			}
+			if len(o.Checksum) > 0 && !hmac.Equal(o.Checksum, sum.Sum(nil)) {
+				return errors.Wrapf(ErrVerificationFailed, "reconstructed file does not match its checksum")
+			}
+			if res != nil && applied < res.skip {
+				return errors.Wrapf(ErrInvalidDelta, "checkpoint past the end of the delta")
+			}
+			final = true
+			break
+		}
+
 		var block []byte
 
 		if len(o.Data) > 0 {
-			block = o.Data
+			// Compressed literals may hold several blocks, they get a buffer of their own.
+			if o.Compression != 0 && unpacked == nil {
+				b, release, err := getBuffer(ctx, opt, opt.literalLen())
+				if err != nil {
+					return err
+				}
+				defer release()
+				unpacked = b
+			}
+			if block, err = opt.literal(o, unpacked); err != nil {
+				return err
+			}
+			stats.LiteralBytes += int64(len(block))
+		} else if o.Dictionary != 0 {
+			d := opt.dictionary
+			if d == nil || d.Version != o.Dictionary {
+				return errors.Errorf("gsync: dictionary version %d not available", o.Dictionary)
+			}
+			if d.Blocks == nil {
+				return errors.Errorf("gsync: dictionary version %d has no blocks", o.Dictionary)
+			}
+
+			n, err := d.Blocks.ReadAt(buffer, int64(o.Index)*int64(len(buffer)))
+			if err != nil && err != io.EOF {
+				return errors.Wrapf(err, "failed reading dictionary block")
+			}
+
+			block = buffer[:n]
 		} else {
-			if f, ok := cache.(*os.File); ok && f == nil {
-				return errors.New("index operation, but cached file was not found")
+			if cache == nil {
+				return ErrNoBasis
 			}
 
 			index := int64(o.Index)
-			n, err := cache.ReadAt(buffer, (index * DefaultBlockSize))
+			n, err := cache.ReadAt(buffer, (index * int64(len(buffer))))
 			if err != nil && err != io.EOF {
 				return errors.Wrapf(err, "failed reading cached block")
 			}
 
 			block = buffer[:n]
 		}
+		size += int64(len(block))
+		sum.Write(block)
+
+		if opt.transform != nil {
+			var err error
+			block, err = opt.transform(o.Index, block)
+			if err != nil {
+				return errors.Wrapf(err, "failed transforming block")
+			}
+		}
 
-		_, err := dst.Write(block)
+		if opt.maxOutputBytes > 0 && written+int64(len(block)) > opt.maxOutputBytes {
+			return ErrOutputTooLarge
+		}
+
+		// Operations applied before the checkpoint resumed from are only accounted for.
+		if res != nil && applied < res.skip {
+			o.Release()
+			written += int64(len(block))
+			applied++
+			if applied == res.skip && written != res.offset {
+				return errors.Wrapf(ErrInvalidDelta, "checkpoint at offset %d does not match the delta", res.offset)
+			}
+			continue
+		}
+
+		n, err := w.Write(block)
+		o.Release()
+		written += int64(n)
 		if err != nil {
 			return errors.Wrapf(err, "failed writing block to destination")
 		}
+
+		applied++
+		if res != nil && res.every > 0 && applied%res.every == 0 {
+			if err := res.record(batch, applied, written); err != nil {
+				return err
+			}
+		}
+
+		if len(o.Data) == 0 {
+			stats.MatchedBlocks++
+		}
+		stats.BytesWritten = written
+		prog.update(&stats, false)
+	}
+
+	if !final {
+		return ErrIncompleteDelta
 	}
+
+	if batch != nil {
+		if err := batch.Flush(); err != nil {
+			return errors.Wrapf(err, "failed writing block to destination")
+		}
+	}
+
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return errors.Wrapf(err, "failed encoding destination")
+		}
+	}
+
+	if err := finalize(dst); err != nil {
+		return err
+	}
+
+	if res != nil && res.every > 0 {
+		if err := res.record(nil, applied, written); err != nil {
+			return err
+		}
+	}
+
+	prog.update(&stats, true)
+	if opt.stats != nil {
+		*opt.stats = stats
+	}
+	return nil
+}
+
+// ApplyVerify applies ops like Apply, but instead of writing the reconstructed file anywhere, it hashes it
+// with a hash created by hashFactory, or SHA-256 if hashFactory is nil, and checks the digest against expected,
+// failing with ErrVerificationFailed on mismatch. It is a cheap way to tell whether a delta would produce the right
+// file before writing it to disk.
+func ApplyVerify(ctx context.Context, expected []byte, hashFactory func() hash.Hash, cache io.ReaderAt, ops <-chan BlockOperation, opts ...Option) error {
+	if hashFactory == nil {
+		hashFactory = sha256.New
+	}
+
+	h := hashFactory()
+	if err := Apply(ctx, h, cache, ops, opts...); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return ErrVerificationFailed
+	}
+	return nil
+}
+
+// ValidateDelta checks, without applying them, that ops are well-formed and can be applied to a cached copy of
+// the file made of basisBlocks blocks, returning the first problem found. It is meant as a cheap check for
+// deltas received from untrusted peers. Every operation must be either a literal, a copy of a block in
+// [0, basisBlocks), a copy of a dictionary block, or the final operation, which must come last and announce
+// a size the other operations can add up to. Dictionary block indexes are not checked, since ValidateDelta
+// knows nothing about dictionaries. Compressed literals are decompressed to tell their size. A delta without
+// final operation fails with ErrIncompleteDelta, any other problem with ErrInvalidDelta. Options tell the block
+// size, as WithBlockSize does, and the Compressor literals were compressed with, as WithCompression does.
+func ValidateDelta(ops []BlockOperation, basisBlocks uint64, opts ...Option) error {
+	var (
+		literal, copies int64
+		lastCopies      int64
+	)
+	opt := newOptions(opts)
+	size := int64(opt.blockLen())
+	buf := make([]byte, opt.literalLen())
+
+	for i, o := range ops {
+		switch {
+		case o.Error != nil:
+			return errors.Wrapf(ErrInvalidDelta, "operation %d reports an error: %v", i, o.Error)
+		case o.Final:
+			if len(o.Data) > 0 || o.Index != 0 || o.Dictionary != 0 {
+				return errors.Wrapf(ErrInvalidDelta, "final operation %d carries a block", i)
+			}
+
+			if i != len(ops)-1 {
+				return errors.Wrapf(ErrInvalidDelta, "final operation %d is followed by %d more", i, len(ops)-1-i)
+			}
+
+			// The last block of the basis may be shorter than the others, but not empty.
+			min := literal + copies*size + lastCopies
+			max := literal + (copies+lastCopies)*size
+			if o.TotalSize < min || o.TotalSize > max {
+				return errors.Wrapf(ErrInvalidDelta, "final operation announces %d bytes, operations add up to between %d and %d", o.TotalSize, min, max)
+			}
+			return nil
+		case o.TotalSize != 0:
+			return errors.Wrapf(ErrInvalidDelta, "operation %d announces a total size but is not final", i)
+		case len(o.Data) > 0:
+			if o.Index != 0 || o.Dictionary != 0 {
+				return errors.Wrapf(ErrInvalidDelta, "literal operation %d also copies a block", i)
+			}
+			data, err := opt.literal(o, buf)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidDelta, "literal operation %d: %v", i, err)
+			}
+			literal += int64(len(data))
+		case o.Compression != 0:
+			return errors.Wrapf(ErrInvalidDelta, "operation %d is compressed but carries no data", i)
+		case o.Dictionary != 0:
+			// Dictionary blocks are all of the block size, but the last one.
+			lastCopies++
+		case o.Index >= basisBlocks:
+			return errors.Wrapf(ErrInvalidDelta, "operation %d copies block %d, the basis has %d", i, o.Index, basisBlocks)
+		case o.Index == basisBlocks-1:
+			lastCopies++
+		default:
+			copies++
+		}
+	}
+
+	return ErrIncompleteDelta
+}
+
+// planBatch is the maximum number of operations Apply looks ahead at when reporting its basis access plan.
+const planBatch = 256
+
+// opReader receives the operations Apply applies. When asked to report the basis access plan, it takes every
+// operation already sent, up to planBatch, whenever it runs out of them, and reports the basis blocks they copy
+// before handing out the first one.
+type opReader struct {
+	ops    <-chan BlockOperation
+	plan   func(indices []uint64)
+	queue  []BlockOperation
+	closed bool
+}
+
+// next returns the next operation, reporting false once ops is closed and no operation is left.
+func (r *opReader) next(ctx context.Context) (BlockOperation, bool, error) {
+	if len(r.queue) == 0 && !r.closed {
+		// Allows for cancellation, even while waiting for operations.
+		select {
+		case <-ctx.Done():
+			return BlockOperation{}, false, errors.Wrapf(ctx.Err(), "failed applying block operations")
+		case o, ok := <-r.ops:
+			if !ok {
+				r.closed = true
+				break
+			}
+			if r.plan == nil {
+				return o, true, nil
+			}
+			r.queue = append(r.queue, o)
+		}
+
+		if r.plan != nil {
+			r.lookAhead()
+		}
+	}
+
+	if len(r.queue) == 0 {
+		return BlockOperation{}, false, nil
+	}
+
+	o := r.queue[0]
+	r.queue = r.queue[1:]
+	return o, true, nil
+}
+
+// lookAhead queues the operations already sent and reports the basis blocks copied by the queue.
+func (r *opReader) lookAhead() {
+ahead:
+	for len(r.queue) < planBatch && !r.closed {
+		select {
+		case o, ok := <-r.ops:
+			if !ok {
+				r.closed = true
+				break ahead
+			}
+			r.queue = append(r.queue, o)
+		default:
+			break ahead
+		}
+	}
+
+	var indices []uint64
+	for _, o := range r.queue {
+		if o.Error == nil && !o.Final && len(o.Data) == 0 && o.Dictionary == 0 {
+			indices = append(indices, o.Index)
+		}
+	}
+
+	if len(indices) > 0 {
+		r.plan(indices)
+	}
+}
+
+// finalize makes sure no data is left behind in dst's buffers, nor past the last block written to it, once
+// the last block has been written.
+func finalize(dst io.Writer) error {
+	if f, ok := dst.(interface {
+		Flush() error
+	}); ok {
+		if err := f.Flush(); err != nil {
+			return errors.Wrapf(err, "failed flushing destination")
+		}
+	}
+
+	// Pipes, terminals and the like can neither be truncated nor synced, and are left alone.
+	if s, ok := dst.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if info, err := s.Stat(); err == nil && !info.Mode().IsRegular() {
+			return nil
+		}
+	}
+
+	if t, ok := dst.(interface {
+		io.Seeker
+		Truncate(size int64) error
+	}); ok {
+		// Destinations that can't seek, like pipes, can't be applied to in place either.
+		if pos, err := t.Seek(0, io.SeekCurrent); err == nil {
+			if err := t.Truncate(pos); err != nil {
+				return errors.Wrapf(err, "failed truncating destination")
+			}
+		}
+	}
+
+	if s, ok := dst.(interface {
+		Sync() error
+	}); ok {
+		if err := s.Sync(); err != nil {
+			return errors.Wrapf(err, "failed syncing destination")
+		}
+	}
+
 	return nil
 }
@@ -5,18 +5,30 @@
 package gsync
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
 	"github.com/pkg/profile"
 )
 
@@ -75,12 +87,18 @@ func TestRollingHash(t *testing.T) {
 
 var alpha = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789\n"
 
+// checksum returns the SHA-256 checksum of data, as carried by final operations.
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
 // srand generates a random string of fixed size.
 func srand(seed int64, size int) []byte {
 	buf := make([]byte, size)
-	rand.Seed(seed)
+	rnd := rand.New(rand.NewSource(seed))
 	for i := 0; i < size; i++ {
-		buf[i] = alpha[rand.Intn(len(alpha))]
+		buf[i] = alpha[rnd.Intn(len(alpha))]
 	}
 	return buf
 }
@@ -148,13 +166,2039 @@ func TestSync(t *testing.T) {
 	}
 }
 
-func Benchmark6kbBlockSize(b *testing.B)    {}
-func Benchmark128kbBlockSize(b *testing.B)  {}
-func Benchmark512kbBlockSize(b *testing.B)  {}
-func Benchmark1024kbBlockSize(b *testing.B) {}
+// TestDiff tests the matching logic synchronously, without going through Sync's channel.
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(30, 2*DefaultBlockSize)
+	source := append([]byte("xyz"), cache...)
 
-func BenchmarkMD5(b *testing.B)     {}
-func BenchmarkSHA256(b *testing.B)  {}
-func BenchmarkSHA512(b *testing.B)  {}
-func BenchmarkMurmur3(b *testing.B) {}
-func BenchmarkXXHash(b *testing.B)  {}
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+
+	remote, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	var ops []BlockOperation
+	err = diff(ctx, bytes.NewReader(source), sha256.New(), remote, newOptions(nil), func(op BlockOperation) error {
+		ops = append(ops, op)
+		return nil
+	})
+	assert.Ok(t, err)
+
+	assert.Equals(t, []BlockOperation{
+		{Data: []byte("xyz")},
+		{Index: 0},
+		{Index: 1},
+		{Final: true, TotalSize: int64(len(source)), Checksum: checksum(source)},
+	}, ops)
+}
+
+// TestSyncLiteralRanges tests that Sync reports the source ranges missing from the basis.
+func TestSyncLiteralRanges(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(220, 2*DefaultBlockSize)
+	source := bytes.Join([][]byte{[]byte("head"), cache[:DefaultBlockSize], []byte("mid"), cache[DefaultBlockSize:], []byte("tail")}, nil)
+
+	tests := []struct {
+		desc   string
+		cache  []byte
+		ranges [][2]int64
+	}{
+		{
+			"partial sync",
+			cache,
+			[][2]int64{{0, 4}, {4 + DefaultBlockSize, 3}, {7 + 2*DefaultBlockSize, 4}},
+		},
+		{
+			"full sync",
+			nil,
+			[][2]int64{{0, int64(len(source))}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sigsCh, err := Signatures(ctx, bytes.NewReader(tt.cache), nil)
+			assert.Ok(t, err)
+
+			table, err := LookUpTable(ctx, sigsCh)
+			assert.Ok(t, err)
+
+			var ranges [][2]int64
+			opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table, WithLiteralRanges(func(start, length int64) {
+				ranges = append(ranges, [2]int64{start, length})
+			}))
+			assert.Ok(t, err)
+
+			Drain(opsCh)
+			assert.Equals(t, tt.ranges, ranges)
+		})
+	}
+}
+
+// TestSyncIndexSalt tests that salted strong checksums differ for identical blocks at different indexes,
+// and that salted syncs only copy blocks to their own index.
+func TestSyncIndexSalt(t *testing.T) {
+	ctx := context.Background()
+	block := srand(230, DefaultBlockSize)
+	cache := bytes.Repeat(block, 2)
+
+	var sigs []BlockSignature
+	err := SignaturesFunc(ctx, bytes.NewReader(cache), nil, func(s BlockSignature) error {
+		sigs = append(sigs, s)
+		return nil
+	}, WithIndexSalt())
+	assert.Ok(t, err)
+	assert.Equals(t, sigs[0].Weak, sigs[1].Weak)
+	assert.Cond(t, !bytes.Equal(sigs[0].Strong, sigs[1].Strong), "salted strong checksums should differ")
+
+	table := map[uint32][]BlockSignature{sigs[0].Weak: sigs}
+	source := bytes.Repeat(block, 3)
+
+	var ops []BlockOperation
+	err = diff(ctx, bytes.NewReader(source), sha256.New(), table, newOptions([]Option{WithIndexSalt()}), func(op BlockOperation) error {
+		ops = append(ops, op)
+		return nil
+	})
+	assert.Ok(t, err)
+
+	// The third block has no basis block at its index, so it is sent as literal.
+	assert.Equals(t, []BlockOperation{
+		{Index: 0},
+		{Index: 1},
+		{Data: block},
+		{Final: true, TotalSize: int64(len(source)), Checksum: checksum(source)},
+	}, ops)
+}
+
+// TestSyncStrongFallback tests that Sync switches to strong checksums only when weak matches are mostly
+// false, and keeps finding blocks after it does.
+func TestSyncStrongFallback(t *testing.T) {
+	ctx := context.Background()
+	filler := bytes.Repeat([]byte{'a'}, DefaultBlockSize)
+	block := srand(150, DefaultBlockSize)
+	cache := append(append([]byte(nil), filler...), block...)
+
+	var sigs []BlockSignature
+	err := SignaturesFunc(ctx, bytes.NewReader(cache), nil, func(s BlockSignature) error {
+		sigs = append(sigs, s)
+		return nil
+	})
+	assert.Ok(t, err)
+
+	// Every full window of the filler matches the weak checksum of the first block, whose strong checksum
+	// never matches.
+	sigs[0].Strong = []byte("bogus")
+	remote := map[uint32][]BlockSignature{sigs[0].Weak: sigs[:1], sigs[1].Weak: sigs[1:]}
+	source := append(bytes.Repeat([]byte{'a'}, DefaultBlockSize+2000), block...)
+
+	tests := []struct {
+		desc  string
+		opts  []Option
+		stats Stats
+	}{
+		{"disabled", nil, Stats{WeakMatches: 2002, StrongMatches: 1}},
+		{"enabled", []Option{WithStrongFallback(0.1)}, Stats{WeakMatches: strongFallbackSample, StrongOnly: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var stats Stats
+
+			ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, append(tt.opts, WithStats(&stats))...)
+			assert.Ok(t, err)
+
+			target := new(bytes.Buffer)
+			assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops))
+			assert.Equals(t, source, target.Bytes())
+			assert.Equals(t, tt.stats, Stats{WeakMatches: stats.WeakMatches, StrongMatches: stats.StrongMatches, StrongOnly: stats.StrongOnly})
+		})
+	}
+}
+
+// TestBlockSize tests syncs with other block sizes than the default, and that disagreeing on it fails.
+func TestBlockSize(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(251, 10*1024+10)
+	source := append(append(append([]byte(nil), cache[:3*1024]...), "inserted"...), cache[4*1024:]...)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(cache), nil, WithBlockSize(1024))
+	assert.Ok(t, err)
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(t, err)
+
+	_, err = Sync(ctx, bytes.NewReader(source), nil, remote, WithBlockSize(2048))
+	assert.Equals(t, ErrBlockSizeMismatch, errors.Cause(err))
+
+	// Sync picks the block size of the signatures.
+	var stats Stats
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, WithStats(&stats))
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops, WithBlockSize(1024)))
+	assert.Equals(t, source, target.Bytes())
+	assert.Equals(t, int64(10), stats.StrongMatches)
+
+	mixed := make(chan BlockSignature, 2)
+	mixed <- BlockSignature{Index: 0, BlockSize: 1024}
+	mixed <- BlockSignature{Index: 1, BlockSize: 2048}
+	close(mixed)
+	_, err = LookUpTable(ctx, mixed)
+	assert.Equals(t, ErrBlockSizeMismatch, errors.Cause(err))
+
+	sized := []BlockSignature{{Index: 0, BlockSize: 1024}, {Index: 1, Error: io.ErrUnexpectedEOF}, {Index: 2, BlockSize: 1024}}
+	assert.Ok(t, CompatibleWith(sized))
+	assert.Ok(t, CompatibleWith(sized, WithBlockSize(1024)))
+	assert.Equals(t, ErrBlockSizeMismatch, errors.Cause(CompatibleWith(sized, WithBlockSize(2048))))
+	sized = append(sized, BlockSignature{Index: 3, BlockSize: 2048})
+	assert.Equals(t, ErrBlockSizeMismatch, errors.Cause(CompatibleWith(sized)))
+
+	assert.Equals(t, MinBlockSize, BlockSizeFor(0))
+	assert.Equals(t, 1000, BlockSizeFor(1000*1000+5))
+	assert.Equals(t, 1000, BlockSizeFor(1007*1007))
+	assert.Equals(t, MaxBlockSize, BlockSizeFor(1<<40))
+}
+
+// TestSuggestWorkers tests that CPU bound workloads get a worker per CPU, IO bound ones half as many, and that
+// there is always at least one worker.
+func TestSuggestWorkers(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	tests := []struct {
+		desc     string
+		procs    int
+		workload Workload
+		workers  int
+	}{
+		{"cpu bound", 8, CPUBound, 8},
+		{"io bound", 8, IOBound, 4},
+		{"io bound odd", 7, IOBound, 3},
+		{"cpu bound single", 1, CPUBound, 1},
+		{"io bound single", 1, IOBound, 1},
+		{"unknown workload", 8, Workload(42), 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			runtime.GOMAXPROCS(tt.procs)
+			assert.Equals(t, tt.workers, SuggestWorkers(tt.workload))
+		})
+	}
+}
+
+// TestSyncDeterministic tests that deltas are the same regardless of the order signatures are loaded in,
+// when several basis blocks match.
+func TestSyncDeterministic(t *testing.T) {
+	ctx := context.Background()
+	block := srand(180, DefaultBlockSize)
+	cache := bytes.Repeat(block, 8)
+	source := append(append([]byte("head"), bytes.Repeat(block, 4)...), "tail"...)
+
+	var sigs []BlockSignature
+	err := SignaturesFunc(ctx, bytes.NewReader(cache), nil, func(s BlockSignature) error {
+		sigs = append(sigs, s)
+		return nil
+	})
+	assert.Ok(t, err)
+
+	var deltas [][]BlockOperation
+	for i := 0; i < 5; i++ {
+		rnd := rand.New(rand.NewSource(int64(i)))
+		table := make(map[uint32][]BlockSignature)
+		for _, j := range rnd.Perm(len(sigs)) {
+			table[sigs[j].Weak] = append(table[sigs[j].Weak], sigs[j])
+		}
+
+		var ops []BlockOperation
+		err := diff(ctx, bytes.NewReader(source), sha256.New(), table, newOptions(nil), func(op BlockOperation) error {
+			ops = append(ops, op)
+			return nil
+		})
+		assert.Ok(t, err)
+		deltas = append(deltas, ops)
+	}
+
+	for _, ops := range deltas {
+		assert.Equals(t, deltas[0], ops)
+	}
+	assert.Equals(t, BlockOperation{Index: 0}, deltas[0][1])
+}
+
+// TestReverseSync tests that the older version of a file can be recovered from its newer version.
+func TestReverseSync(t *testing.T) {
+	ctx := context.Background()
+	older := srand(200, 4*DefaultBlockSize)
+	newer := append(append(append([]byte(nil), older[:2*DefaultBlockSize]...), "inserted"...), older[2*DefaultBlockSize:]...)
+
+	opsCh, err := ReverseSync(ctx, bytes.NewReader(newer), bytes.NewReader(older), md5.New())
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(newer), opsCh))
+	assert.Equals(t, older, target.Bytes())
+}
+
+// TestLookUpTableMaxBucketDepth tests that buckets stop growing past the configured depth.
+func TestLookUpTableMaxBucketDepth(t *testing.T) {
+	ctx := context.Background()
+	cache := append(bytes.Repeat(srand(210, DefaultBlockSize), 8), srand(211, DefaultBlockSize)...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+
+	l := new(testLogger)
+	table, err := LookUpTable(ctx, sigsCh, WithMaxBucketDepth(2), WithLogger(l))
+	assert.Ok(t, err)
+
+	assert.Equals(t, 2, len(table))
+	for _, bs := range table {
+		assert.Cond(t, len(bs) <= 2, "buckets should hold at most 2 signatures")
+	}
+	assert.Equals(t, testLogger{"gsync: dropped 6 signatures from full lookup table buckets"}, *l)
+}
+
+// TestSyncDictionary tests that a first-time sync copies blocks from the dictionary.
+func TestSyncDictionary(t *testing.T) {
+	ctx := context.Background()
+	dict := srand(80, 2*DefaultBlockSize)
+	source := append(append([]byte("head"), dict[DefaultBlockSize:]...), "tail"...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(dict), nil)
+	assert.Ok(t, err)
+
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	d := &Dictionary{Version: 1, Signatures: table, Blocks: bytes.NewReader(dict)}
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, nil, WithDictionary(d))
+	assert.Ok(t, err)
+
+	var ops []BlockOperation
+	for o := range opsCh {
+		ops = append(ops, o)
+	}
+	assert.Equals(t, BlockOperation{Index: 1, Dictionary: 1}, ops[1])
+
+	replay := func() <-chan BlockOperation {
+		c := make(chan BlockOperation, len(ops))
+		for _, o := range ops {
+			c <- o
+		}
+		close(c)
+		return c
+	}
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(nil), replay(), WithDictionary(d)))
+	assert.Equals(t, source, target.Bytes())
+
+	d2 := &Dictionary{Version: 2, Blocks: bytes.NewReader(dict)}
+	err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(nil), replay(), WithDictionary(d2))
+	assert.Cond(t, err != nil, "dictionary version mismatch should fail")
+
+	// Dictionaries without blocks fail instead of panicking.
+	d3 := &Dictionary{Version: 1, Signatures: table}
+	err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(nil), replay(), WithDictionary(d3))
+	assert.Cond(t, err != nil, "dictionary without blocks should fail")
+	err = ApplyAt(ctx, new(memWriterAt), bytes.NewReader(nil), replay(), WithDictionary(d3))
+	assert.Cond(t, err != nil, "dictionary without blocks should fail")
+}
+
+// TestSyncTranscoder tests syncing compressed files through their decompressed contents.
+func TestSyncTranscoder(t *testing.T) {
+	ctx := context.Background()
+	data := srand(110, 4*DefaultBlockSize)
+	edited := append(append(append([]byte(nil), data[:DefaultBlockSize]...), "edit"...), data[DefaultBlockSize:]...)
+
+	gz := func(b []byte) []byte {
+		buf := new(bytes.Buffer)
+		w, err := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+		assert.Ok(t, err)
+		_, err = w.Write(b)
+		assert.Ok(t, err)
+		assert.Ok(t, w.Close())
+		return buf.Bytes()
+	}
+	cache, source := gz(data), gz(edited)
+
+	tests := []struct {
+		desc   string
+		enc    Encoder
+		output []byte
+	}{
+		{"recompressed", GzipEncoder(gzip.BestSpeed), source},
+		{"store only", nil, edited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opt := WithTranscoder(GzipDecoder, tt.enc)
+			sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil, opt)
+			assert.Ok(t, err)
+
+			table, err := LookUpTable(ctx, sigsCh)
+			assert.Ok(t, err)
+			assert.Equals(t, 4, len(table))
+
+			opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table, opt)
+			assert.Ok(t, err)
+
+			target := new(bytes.Buffer)
+			assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh, opt))
+			assert.Equals(t, tt.output, target.Bytes())
+		})
+	}
+}
+
+type testLogger []string
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, args...))
+}
+
+// TestLogger tests that Sync and Apply log every operation.
+func TestLogger(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(120, DefaultBlockSize)
+	source := append([]byte("head"), cache...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	sl, al := new(testLogger), new(testLogger)
+	opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table, WithLogger(sl))
+	assert.Ok(t, err)
+	assert.Ok(t, Apply(ctx, new(bytes.Buffer), bytes.NewReader(cache), opsCh, WithLogger(al)))
+
+	assert.Equals(t, testLogger{
+		"sync: literal, 4 bytes",
+		"sync: copy block 0",
+		"sync: final, total size 6148",
+	}, *sl)
+	assert.Equals(t, testLogger{
+		"apply: literal, 4 bytes",
+		"apply: copy block 0",
+		"apply: final, total size 6148",
+	}, *al)
+}
+
+// TestBufferAllocator tests that syncs take their buffers from the allocator, give them all back, and wait
+// for memory to be available.
+func TestBufferAllocator(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(145, 4*DefaultBlockSize)
+	source := append([]byte("prefix"), cache...)
+	// Signatures needs a block buffer and a read buffer, Sync a window of two blocks and Apply a block buffer.
+	a := NewLimitedAllocator(3 * DefaultBlockSize)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(cache), nil, WithBufferAllocator(a), WithReadSize(2*DefaultBlockSize))
+	assert.Ok(t, err)
+
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(t, err)
+
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, WithBufferAllocator(a))
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops, WithBufferAllocator(a)))
+	assert.Equals(t, source, target.Bytes())
+
+	// Sync gives its buffer back right before closing ops.
+	Drain(ops)
+	a.mu.Lock()
+	assert.Equals(t, int64(0), a.used)
+	a.mu.Unlock()
+
+	buf, err := a.Allocate(ctx, 3*DefaultBlockSize)
+	assert.Ok(t, err)
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = a.Allocate(tctx, 1)
+	assert.Equals(t, context.DeadlineExceeded, err)
+
+	a.Release(buf)
+	_, err = a.Allocate(ctx, 1)
+	assert.Ok(t, err)
+}
+
+// TestSyncer tests that a Syncer can be reused to sync several files.
+func TestSyncer(t *testing.T) {
+	ctx := context.Background()
+	s := NewSyncer(nil)
+
+	for i, size := range []int{DefaultBlockSize + 10, 3 * DefaultBlockSize} {
+		cache := srand(int64(70+i), size)
+		source := append(append([]byte(nil), cache...), "tail"...)
+
+		sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+
+		s.Reset()
+		assert.Ok(t, s.LoadSignatures(ctx, sigsCh))
+
+		opsCh, err := s.Sync(ctx, bytes.NewReader(source))
+		assert.Ok(t, err)
+
+		target := new(bytes.Buffer)
+		assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), opsCh))
+		assert.Equals(t, source, target.Bytes())
+	}
+}
+
+// TestSignatureBuilder tests that signatures built incrementally match the ones calculated by Signatures.
+func TestSignatureBuilder(t *testing.T) {
+	ctx := context.Background()
+	data := srand(40, 3*DefaultBlockSize+100)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+
+	var expected []BlockSignature
+	for s := range sigsCh {
+		expected = append(expected, s)
+	}
+
+	var sigs []BlockSignature
+	b := NewSignatureBuilder(nil)
+	for _, n := range []int{10, DefaultBlockSize, 2*DefaultBlockSize - 10} {
+		sigs = append(sigs, b.Append(data[:n])...)
+		data = data[n:]
+	}
+	assert.Equals(t, expected[:3], sigs)
+
+	_, ok := b.Flush()
+	assert.Cond(t, !ok, "there should be no partial block")
+
+	b.Append(data)
+	s, ok := b.Flush()
+	assert.Cond(t, ok, "there should be a partial block")
+	assert.Equals(t, expected[3], s)
+}
+
+// TestSignaturesStartIndex tests that signing the tail of a file yields the same signatures as signing the whole file.
+func TestSignaturesStartIndex(t *testing.T) {
+	ctx := context.Background()
+	data := srand(50, 3*DefaultBlockSize+100)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+
+	var expected []BlockSignature
+	for s := range sigsCh {
+		expected = append(expected, s)
+	}
+
+	sigsCh, err = Signatures(ctx, bytes.NewReader(data[2*DefaultBlockSize:]), nil, WithStartIndex(2, 2*DefaultBlockSize))
+	assert.Ok(t, err)
+
+	var tail []BlockSignature
+	for s := range sigsCh {
+		tail = append(tail, s)
+	}
+	assert.Equals(t, expected[2:], tail)
+
+	_, err = Signatures(ctx, bytes.NewReader(data), nil, WithStartIndex(2, 100))
+	assert.Cond(t, err != nil, "misaligned start offset should fail")
+}
+
+// TestSignaturesFunc tests that SignaturesFunc calculates the same signatures as Signatures and stops on errors.
+func TestSignaturesFunc(t *testing.T) {
+	ctx := context.Background()
+	data := srand(60, 3*DefaultBlockSize+100)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+
+	var expected []BlockSignature
+	for s := range sigsCh {
+		expected = append(expected, s)
+	}
+
+	var sigs []BlockSignature
+	err = SignaturesFunc(ctx, bytes.NewReader(data), nil, func(s BlockSignature) error {
+		sigs = append(sigs, s)
+		return nil
+	})
+	assert.Ok(t, err)
+	assert.Equals(t, expected, sigs)
+
+	stop := errors.New("stop")
+	sigs = sigs[:0]
+	err = SignaturesFunc(ctx, bytes.NewReader(data), nil, func(s BlockSignature) error {
+		sigs = append(sigs, s)
+		return stop
+	})
+	assert.Equals(t, stop, err)
+	assert.Equals(t, 1, len(sigs))
+}
+
+// TestSyncCancel tests that Sync stops sending operations once its context is cancelled.
+func TestSyncCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opsCh, err := Sync(ctx, bytes.NewReader(srand(90, 100*DefaultBlockSize)), nil, nil)
+	assert.Ok(t, err)
+
+	<-opsCh
+	cancel()
+
+	var n int
+	for range opsCh {
+		n++
+	}
+	assert.Cond(t, n <= 2, "Sync should stop sending operations after cancellation")
+}
+
+// TestCachedSignatures tests that signatures are taken from the cache until the file changes.
+func TestCachedSignatures(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "gsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	assert.Ok(t, ioutil.WriteFile(path, srand(100, 2*DefaultBlockSize), 0640))
+
+	cache := new(MemorySignatureCache)
+	sigs, err := CachedSignatures(ctx, cache, path, nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(sigs))
+
+	// Tamper with the cached signatures to tell whether they are returned.
+	fi, err := os.Stat(path)
+	assert.Ok(t, err)
+	cache.Put(SignatureKey{Path: path, Size: fi.Size(), ModTime: fi.ModTime()}, sigs[:1])
+
+	sigs, err = CachedSignatures(ctx, cache, path, nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(sigs))
+
+	assert.Ok(t, ioutil.WriteFile(path, srand(100, 3*DefaultBlockSize), 0640))
+	sigs, err = CachedSignatures(ctx, cache, path, nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 3, len(sigs))
+}
+
+// TestDiffMerkle tests that comparing merkle trees finds the changed blocks.
+func TestDiffMerkle(t *testing.T) {
+	ctx := context.Background()
+	tree := func(data []byte) *MerkleSignature {
+		sigsCh, err := Signatures(ctx, bytes.NewReader(data), nil)
+		assert.Ok(t, err)
+
+		m, err := NewMerkleSignature(ctx, sigsCh, nil)
+		assert.Ok(t, err)
+		return m
+	}
+
+	a := srand(130, 16*DefaultBlockSize)
+	b := append(append([]byte(nil), a...), srand(131, 2*DefaultBlockSize)...)
+	b[3*DefaultBlockSize] ^= 0xff
+	b[10*DefaultBlockSize+5] ^= 0xff
+
+	ta, tb := tree(a), tree(b)
+	assert.Equals(t, uint64(16), ta.Blocks())
+	assert.Equals(t, []uint64(nil), DiffMerkle(ta, tree(a)))
+	assert.Equals(t, []uint64{3, 10, 16, 17}, DiffMerkle(ta, tb))
+	assert.Equals(t, []uint64{3, 10, 16, 17}, DiffMerkle(tb, ta))
+	assert.Equals(t, []uint64{0, 1}, DiffMerkle(tree(nil), tree(a[:2*DefaultBlockSize])))
+
+	// Signatures that skip blocks, as resumed scans produce, are rejected instead of padding the tree.
+	sigsCh := make(chan BlockSignature, 1)
+	sigsCh <- BlockSignature{Index: 1 << 40, Strong: []byte("strong")}
+	close(sigsCh)
+	_, err := NewMerkleSignature(ctx, sigsCh, nil)
+	assert.Cond(t, err != nil, "expected an error for an out of order signature")
+}
+
+// TestResumeSignatures tests that an interrupted scan resumes from its last checkpoint.
+func TestResumeSignatures(t *testing.T) {
+	data := srand(140, 10*DefaultBlockSize+100)
+
+	sigsCh, err := Signatures(context.Background(), bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+
+	var expected []BlockSignature
+	for s := range sigsCh {
+		expected = append(expected, s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	checkpoints := new(bytes.Buffer)
+
+	var sigs []BlockSignature
+	err = SignaturesFunc(ctx, bytes.NewReader(data), nil, func(s BlockSignature) error {
+		sigs = append(sigs, s)
+		if s.Index == 6 {
+			cancel()
+		}
+		return nil
+	}, WithCheckpoint(checkpoints, 3))
+	assert.Equals(t, context.Canceled, err)
+
+	// Signatures past the last checkpoint are lost, as if they had not been persisted.
+	sigs = sigs[:6]
+
+	sigsCh, err = ResumeSignatures(context.Background(), bytes.NewReader(data), nil, checkpoints)
+	assert.Ok(t, err)
+
+	for s := range sigsCh {
+		sigs = append(sigs, s)
+	}
+	assert.Equals(t, expected, sigs)
+}
+
+// TestValidateDelta tests that malformed deltas are rejected.
+func TestValidateDelta(t *testing.T) {
+	tests := []struct {
+		desc string
+		ops  []BlockOperation
+		err  error
+	}{
+		{
+			"valid",
+			[]BlockOperation{{Data: []byte("abc")}, {Index: 0}, {Index: 1}, {Final: true, TotalSize: DefaultBlockSize + 103}},
+			nil,
+		},
+		{
+			"missing final operation",
+			[]BlockOperation{{Data: []byte("abc")}, {Index: 0}},
+			ErrIncompleteDelta,
+		},
+		{
+			"block out of range",
+			[]BlockOperation{{Index: 2}, {Final: true, TotalSize: DefaultBlockSize}},
+			ErrInvalidDelta,
+		},
+		{
+			"operations after final",
+			[]BlockOperation{{Final: true}, {Data: []byte("abc")}},
+			ErrInvalidDelta,
+		},
+		{
+			"wrong total size",
+			[]BlockOperation{{Index: 0}, {Final: true, TotalSize: DefaultBlockSize + 1}},
+			ErrInvalidDelta,
+		},
+		{
+			"literal copying a block",
+			[]BlockOperation{{Index: 1, Data: []byte("abc")}, {Final: true, TotalSize: 3}},
+			ErrInvalidDelta,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := ValidateDelta(tt.ops, 2)
+			assert.Equals(t, tt.err, errors.Cause(err))
+		})
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// TestApplyMulti tests that ApplyMulti writes to all destinations and reports the failed ones.
+func TestApplyMulti(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(170, 2*DefaultBlockSize)
+	source := append([]byte("head"), cache...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+
+	table, err := LookUpTable(ctx, sigsCh)
+	assert.Ok(t, err)
+
+	tests := []struct {
+		desc string
+		opts []Option
+		ok   bool
+	}{
+		{"stop on error", nil, false},
+		{"continue on error", []Option{WithContinueOnWriteError()}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opsCh, err := Sync(ctx, bytes.NewReader(source), nil, table)
+			assert.Ok(t, err)
+
+			a, b := new(bytes.Buffer), new(bytes.Buffer)
+			err = ApplyMulti(ctx, []io.Writer{a, failingWriter{}, b}, bytes.NewReader(cache), opsCh, tt.opts...)
+			Drain(opsCh)
+
+			errs, ok := errors.Cause(err).(DestinationErrors)
+			assert.Cond(t, ok, "write errors should be reported")
+			assert.Equals(t, 1, len(errs))
+			assert.Cond(t, errs[1] != nil, "the failing destination should be reported")
+
+			if tt.ok {
+				assert.Equals(t, source, a.Bytes())
+				assert.Equals(t, source, b.Bytes())
+			}
+		})
+	}
+}
+
+// TestApplyFlush tests that Apply flushes buffered destinations once all operations are applied.
+func TestApplyFlush(t *testing.T) {
+	ops := make(chan BlockOperation, 2)
+	ops <- BlockOperation{Data: []byte("hello world")}
+	ops <- BlockOperation{Final: true, TotalSize: 11}
+	close(ops)
+
+	target := new(bytes.Buffer)
+	w := bufio.NewWriter(target)
+
+	err := Apply(context.Background(), w, bytes.NewReader(nil), ops)
+	assert.Ok(t, err)
+	assert.Equals(t, 0, w.Buffered())
+	assert.Equals(t, []byte("hello world"), target.Bytes())
+}
+
+// TestApplyTruncate tests that applying in place over a larger file leaves none of its old data behind.
+func TestApplyTruncate(t *testing.T) {
+	f, err := ioutil.TempFile("", "gsync")
+	assert.Ok(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cache := srand(143, 4*DefaultBlockSize)
+	_, err = f.Write(cache)
+	assert.Ok(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.Ok(t, err)
+
+	ops := make(chan BlockOperation, 3)
+	ops <- BlockOperation{Index: 0}
+	ops <- BlockOperation{Data: []byte("hello world")}
+	ops <- BlockOperation{Final: true, TotalSize: DefaultBlockSize + 11}
+	close(ops)
+
+	assert.Ok(t, Apply(context.Background(), f, bytes.NewReader(cache), ops))
+
+	data, err := ioutil.ReadFile(f.Name())
+	assert.Ok(t, err)
+	assert.Equals(t, append(cache[:DefaultBlockSize:DefaultBlockSize], "hello world"...), data)
+}
+
+// TestApplyPipe tests that applying to files that can't be synced nor truncated, as pipes, works.
+func TestApplyPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.Ok(t, err)
+	defer r.Close()
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		received <- data
+	}()
+
+	ops := make(chan BlockOperation, 2)
+	ops <- BlockOperation{Data: []byte("hello world")}
+	ops <- BlockOperation{Final: true, TotalSize: 11}
+	close(ops)
+
+	assert.Ok(t, Apply(context.Background(), w, nil, ops))
+	assert.Ok(t, w.Close())
+	assert.Equals(t, []byte("hello world"), <-received)
+}
+
+// countingReaderAt counts the reads issued to it, which may come from several goroutines.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int32
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.r.ReadAt(p, off)
+}
+
+// TestApplyReadAhead tests that Apply batches reads of the cached file with WithReadAhead, whatever order
+// blocks are copied in.
+func TestApplyReadAhead(t *testing.T) {
+	cache := srand(144, 10*DefaultBlockSize+100)
+	order := []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 3, 4, 0}
+
+	ops := make(chan BlockOperation, len(order)+1)
+	var expected []byte
+	for _, i := range order {
+		ops <- BlockOperation{Index: i}
+
+		end := int(i+1) * DefaultBlockSize
+		if end > len(cache) {
+			end = len(cache)
+		}
+		expected = append(expected, cache[int(i)*DefaultBlockSize:end]...)
+	}
+	ops <- BlockOperation{Final: true, TotalSize: int64(len(expected))}
+	close(ops)
+
+	r := &countingReaderAt{r: bytes.NewReader(cache)}
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(context.Background(), target, r, ops, WithReadAhead(4)))
+	assert.Equals(t, expected, target.Bytes())
+	assert.Cond(t, int(atomic.LoadInt32(&r.reads)) < len(order), "reads should be batched")
+}
+
+// TestPatchFile tests that patch files reconstruct the source, through Apply as well as by reading them at
+// random, and that corrupted ones are rejected.
+func TestPatchFile(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(146, 6*DefaultBlockSize+300)
+	source := append(append(append([]byte("head"), cache[:2*DefaultBlockSize]...), "middle"...), cache[3*DefaultBlockSize:]...)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(t, err)
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote)
+	assert.Ok(t, err)
+
+	patch := new(bytes.Buffer)
+	assert.Ok(t, WritePatch(ctx, patch, int64(len(cache)), ops))
+
+	pf, err := OpenPatchFile(bytes.NewReader(patch.Bytes()), int64(patch.Len()))
+	assert.Ok(t, err)
+	assert.Equals(t, int64(len(source)), pf.Size())
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), pf.Operations(ctx)))
+	assert.Equals(t, source, target.Bytes())
+
+	r := pf.Reader(bytes.NewReader(cache))
+	for _, off := range []int64{0, 3, 4, DefaultBlockSize + 10, 2*DefaultBlockSize + 2, int64(len(source)) - 100} {
+		b := make([]byte, DefaultBlockSize)
+		n, err := r.ReadAt(b, off)
+		if err != io.EOF {
+			assert.Ok(t, err)
+		}
+		assert.Equals(t, source[off:off+int64(n)], b[:n])
+	}
+
+	assert.Equals(t, sha256.Size, len(pf.Checksum()))
+
+	corrupted := append([]byte(nil), patch.Bytes()...)
+	corrupted[len(corrupted)-patchFooterLen-len(pf.Checksum())-patchEntrySize+8]++
+	_, err = OpenPatchFile(bytes.NewReader(corrupted), int64(len(corrupted)))
+	assert.Equals(t, ErrInvalidPatch, errors.Cause(err))
+
+	_, err = OpenPatchFile(bytes.NewReader(patch.Bytes()), int64(patch.Len()-1))
+	assert.Equals(t, ErrInvalidPatch, errors.Cause(err))
+
+	// Copies shorter than their block would make Operations and Reader disagree. The first entry is the "head"
+	// literal, grown by a byte taken from the copy of the first block following it.
+	tampered := append([]byte(nil), patch.Bytes()...)
+	index := tampered[len(tampered)-patchFooterLen-len(pf.Checksum())-len(pf.entries)*patchEntrySize:]
+	assert.Equals(t, []uint8{patchLiteral, patchCopy}, []uint8{index[0], index[patchEntrySize]})
+	binary.BigEndian.PutUint32(index[4:], 5)
+	binary.BigEndian.PutUint32(index[patchEntrySize+4:], DefaultBlockSize-1)
+	binary.BigEndian.PutUint64(index[patchEntrySize+8:], 5)
+	_, err = OpenPatchFile(bytes.NewReader(tampered), int64(len(tampered)))
+	assert.Equals(t, ErrInvalidPatch, errors.Cause(err))
+}
+
+// TestPatchFileVerification tests that files reconstructed from a patch file are verified against the checksum
+// it stores, so corrupted literal data or a changed basis are caught.
+func TestPatchFileVerification(t *testing.T) {
+	ctx := context.Background()
+
+	basis := srand(265, 4*DefaultBlockSize)
+	source := append(append([]byte("head"), basis...), "tail"...)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(basis), nil)
+	assert.Ok(t, err)
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(t, err)
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote)
+	assert.Ok(t, err)
+
+	patch := new(bytes.Buffer)
+	assert.Ok(t, WritePatch(ctx, patch, int64(len(basis)), ops))
+
+	apply := func(patch, basis []byte) error {
+		pf, err := OpenPatchFile(bytes.NewReader(patch), int64(len(patch)))
+		assert.Ok(t, err)
+		return Apply(ctx, ioutil.Discard, bytes.NewReader(basis), pf.Operations(ctx))
+	}
+	assert.Ok(t, apply(patch.Bytes(), basis))
+
+	// The literal data of the first operation follows the header.
+	corrupted := append([]byte(nil), patch.Bytes()...)
+	corrupted[len(patchMagic)]++
+	assert.Equals(t, ErrVerificationFailed, errors.Cause(apply(corrupted, basis)))
+
+	changed := append([]byte(nil), basis...)
+	changed[DefaultBlockSize]++
+	assert.Equals(t, ErrVerificationFailed, errors.Cause(apply(patch.Bytes(), changed)))
+}
+
+// TestApplyBasisAccessPlan tests that Apply reports the basis blocks it copies before reading them.
+func TestApplyBasisAccessPlan(t *testing.T) {
+	cache := srand(148, 4*DefaultBlockSize)
+	r := &countingReaderAt{r: bytes.NewReader(cache)}
+
+	ops := make(chan BlockOperation, 6)
+	ops <- BlockOperation{Index: 2}
+	ops <- BlockOperation{Data: []byte("hello")}
+	ops <- BlockOperation{Index: 0}
+	ops <- BlockOperation{Index: 7, Dictionary: 1}
+	ops <- BlockOperation{Index: 3}
+	ops <- BlockOperation{Final: true, TotalSize: 3*DefaultBlockSize + 5 + 11}
+	close(ops)
+
+	dict := &Dictionary{Version: 1, Blocks: bytes.NewReader(append(make([]byte, 7*DefaultBlockSize), "dictionary!"...))}
+
+	var plans [][]uint64
+	err := Apply(context.Background(), new(bytes.Buffer), r, ops, WithDictionary(dict), WithBasisAccessPlan(func(indices []uint64) {
+		assert.Equals(t, int32(0), atomic.LoadInt32(&r.reads))
+		plans = append(plans, indices)
+	}))
+	assert.Ok(t, err)
+	assert.Equals(t, [][]uint64{{2, 0, 3}}, plans)
+}
+
+// TestApplyPreallocate tests that preallocating the destination leaves it with the reconstructed file only.
+func TestApplyPreallocate(t *testing.T) {
+	f, err := ioutil.TempFile("", "gsync")
+	assert.Ok(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ops := make(chan BlockOperation, 2)
+	ops <- BlockOperation{Data: []byte("hello world")}
+	ops <- BlockOperation{Final: true, TotalSize: 11}
+	close(ops)
+
+	assert.Ok(t, Apply(context.Background(), f, nil, ops, WithPreallocate(10*DefaultBlockSize)))
+
+	data, err := ioutil.ReadFile(f.Name())
+	assert.Ok(t, err)
+	assert.Equals(t, []byte("hello world"), data)
+}
+
+// TestPatch tests in-memory round trips through Patch and Unpatch.
+func TestPatch(t *testing.T) {
+	ctx := context.Background()
+	basis := srand(152, 5*DefaultBlockSize+42)
+	source := append(append([]byte(nil), basis[:3*DefaultBlockSize]...), "tail"...)
+
+	delta, err := Patch(ctx, basis, source)
+	assert.Ok(t, err)
+	assert.Cond(t, len(delta) < len(source), "delta should be smaller than the source")
+
+	patched, err := Unpatch(ctx, basis, delta)
+	assert.Ok(t, err)
+	assert.Equals(t, source, patched)
+
+	_, err = Unpatch(ctx, basis[1:], delta)
+	assert.Equals(t, ErrInvalidPatch, errors.Cause(err))
+
+	// Patch files tell whether their checksum is keyed, the key has to be given when it is, and only then.
+	key := WithHashKey([]byte("secret"))
+	keyed, err := Patch(ctx, basis, source, key)
+	assert.Ok(t, err)
+	patched, err = Unpatch(ctx, basis, keyed, key)
+	assert.Ok(t, err)
+	assert.Equals(t, source, patched)
+
+	_, err = Unpatch(ctx, basis, keyed)
+	assert.Cond(t, err != nil, "keyed patch without the key should fail")
+	_, err = Unpatch(ctx, basis, delta, key)
+	assert.Cond(t, err != nil, "patch without a key should fail with one")
+}
+
+// TestApplyIncompleteDelta tests that Apply detects deltas missing operations.
+func TestApplyIncompleteDelta(t *testing.T) {
+	tests := []struct {
+		desc string
+		ops  []BlockOperation
+	}{
+		{
+			"missing final operation",
+			[]BlockOperation{{Data: []byte("hello")}},
+		},
+		{
+			"missing data",
+			[]BlockOperation{{Data: []byte("hello")}, {Final: true, TotalSize: 11}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ops := make(chan BlockOperation, len(tt.ops))
+			for _, o := range tt.ops {
+				ops <- o
+			}
+			close(ops)
+
+			err := Apply(context.Background(), new(bytes.Buffer), bytes.NewReader(nil), ops)
+			assert.Equals(t, ErrIncompleteDelta, errors.Cause(err))
+		})
+	}
+}
+
+// TestApplyNoBasis tests that Apply works without a cached file as long as no blocks are copied from it.
+func TestApplyNoBasis(t *testing.T) {
+	ops := make(chan BlockOperation, 2)
+	ops <- BlockOperation{Data: []byte("hello world")}
+	ops <- BlockOperation{Final: true, TotalSize: 11}
+	close(ops)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(context.Background(), target, nil, ops))
+	assert.Equals(t, []byte("hello world"), target.Bytes())
+
+	ops = make(chan BlockOperation, 2)
+	ops <- BlockOperation{Index: 0}
+	ops <- BlockOperation{Final: true, TotalSize: 11}
+	close(ops)
+
+	var f *os.File
+	err := Apply(context.Background(), new(bytes.Buffer), f, ops)
+	assert.Equals(t, ErrNoBasis, err)
+}
+
+// TestApplyVerify tests that ApplyVerify checks the digest of the reconstructed file.
+func TestApplyVerify(t *testing.T) {
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+
+	delta := func() <-chan BlockOperation {
+		ops := make(chan BlockOperation, 2)
+		ops <- BlockOperation{Data: content}
+		ops <- BlockOperation{Final: true, TotalSize: int64(len(content))}
+		close(ops)
+		return ops
+	}
+
+	assert.Ok(t, ApplyVerify(context.Background(), sum[:], sha256.New, nil, delta()))
+	assert.Ok(t, ApplyVerify(context.Background(), sum[:], nil, nil, delta()))
+
+	err := ApplyVerify(context.Background(), sum[1:], sha256.New, nil, delta())
+	assert.Equals(t, ErrVerificationFailed, err)
+}
+
+// TestTimeout tests that calls running out of the time set with WithTimeout fail with ErrTimeout, and that it
+// is told apart from the cancellation of the caller's context.
+func TestTimeout(t *testing.T) {
+	ops := make(chan BlockOperation)
+	err := Apply(context.Background(), new(bytes.Buffer), nil, ops, WithTimeout(10*time.Millisecond))
+	assert.Equals(t, ErrTimeout, err)
+	assert.Cond(t, errors.Is(err, context.DeadlineExceeded), "ErrTimeout should wrap context.DeadlineExceeded")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Apply(ctx, new(bytes.Buffer), nil, ops, WithTimeout(time.Hour))
+	assert.Equals(t, context.Canceled, errors.Cause(err))
+
+	// Nobody reads signatures, so the timeout runs out while Signatures waits to send the first one.
+	sigs, err := Signatures(context.Background(), bytes.NewReader(srand(141, DefaultBlockSize)), nil, WithTimeout(10*time.Millisecond))
+	assert.Ok(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	s := <-sigs
+	assert.Equals(t, ErrTimeout, s.Error)
+	_, ok := <-sigs
+	assert.Cond(t, !ok, "channel should be closed")
+}
+
+// TestApplyMaxOutputBytes tests that Apply stops before writing past the configured limit.
+func TestApplyMaxOutputBytes(t *testing.T) {
+	ops := make(chan BlockOperation, 2)
+	ops <- BlockOperation{Data: []byte("hello ")}
+	ops <- BlockOperation{Data: []byte("world")}
+	close(ops)
+
+	target := new(bytes.Buffer)
+	err := Apply(context.Background(), target, bytes.NewReader(nil), ops, WithMaxOutputBytes(10))
+	assert.Equals(t, ErrOutputTooLarge, err)
+	assert.Equals(t, []byte("hello "), target.Bytes())
+}
+
+// TestApplyBlockTransform tests that Apply writes transformed blocks and aborts on transform errors.
+func TestApplyBlockTransform(t *testing.T) {
+	tests := []struct {
+		desc   string
+		fn     func(uint64, []byte) ([]byte, error)
+		output []byte
+		err    bool
+	}{
+		{
+			"upper case",
+			func(_ uint64, data []byte) ([]byte, error) {
+				return bytes.ToUpper(data), nil
+			},
+			[]byte("HELLO WORLD"),
+			false,
+		},
+		{
+			"failed transform",
+			func(_ uint64, data []byte) ([]byte, error) {
+				return nil, errors.New("boom")
+			},
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ops := make(chan BlockOperation, 2)
+			ops <- BlockOperation{Data: []byte("hello world")}
+			ops <- BlockOperation{Final: true, TotalSize: 11}
+			close(ops)
+
+			target := new(bytes.Buffer)
+			err := Apply(context.Background(), target, bytes.NewReader(nil), ops, WithBlockTransform(tt.fn))
+			assert.Equals(t, tt.err, err != nil)
+			assert.Equals(t, tt.output, target.Bytes())
+		})
+	}
+}
+
+// slowWriter simulates a destination where every write call is expensive.
+type slowWriter struct {
+	writes int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.writes++
+	time.Sleep(50 * time.Microsecond)
+	return len(p), nil
+}
+
+// TestWASMBuild tests that the package builds for WebAssembly, so the algorithm keeps working where there is
+// no operating system underneath.
+func TestWASMBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping WebAssembly build in short mode")
+	}
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+
+	cmd := exec.Command(goBin, "build", ".")
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("WebAssembly build failed: %v\n%s", err, out)
+	}
+}
+
+// Example_inMemory computes and applies a delta entirely in memory, as a WebAssembly build running in a
+// browser would.
+func Example_inMemory() {
+	ctx := context.Background()
+	old := srand(190, 3*DefaultBlockSize)
+	updated := append([]byte("hello "), old...)
+
+	sigsCh, err := Signatures(ctx, bytes.NewReader(old), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	table, err := LookUpTable(ctx, sigsCh)
+	if err != nil {
+		panic(err)
+	}
+
+	opsCh, err := Sync(ctx, bytes.NewReader(updated), nil, table)
+	if err != nil {
+		panic(err)
+	}
+
+	target := new(bytes.Buffer)
+	if err := Apply(ctx, target, bytes.NewReader(old), opsCh); err != nil {
+		panic(err)
+	}
+
+	fmt.Println(bytes.Equal(updated, target.Bytes()))
+	// Output: true
+}
+
+func BenchmarkApplyWriteBatch(b *testing.B) {
+	const ops, size = 1024, 512
+	data := srand(150, size)
+
+	for _, batch := range []int{0, 64 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			b.SetBytes(ops * size)
+			w := new(slowWriter)
+
+			for i := 0; i < b.N; i++ {
+				opsCh := make(chan BlockOperation, ops+1)
+				for j := 0; j < ops; j++ {
+					opsCh <- BlockOperation{Data: data}
+				}
+				opsCh <- BlockOperation{Final: true, TotalSize: ops * size}
+				close(opsCh)
+
+				err := Apply(context.Background(), w, nil, opsCh, WithWriteBatchSize(batch))
+				assert.Ok(b, err)
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// countingReader counts the reads issued to it.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func BenchmarkSignaturesReadSize(b *testing.B) {
+	data := srand(160, 16*1024*1024)
+
+	for _, size := range []int{0, DefaultReadSize} {
+		b.Run(fmt.Sprintf("read=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var reads int
+
+			for i := 0; i < b.N; i++ {
+				r := &countingReader{r: bytes.NewReader(data)}
+				err := SignaturesFunc(context.Background(), r, md5.New(), func(BlockSignature) error {
+					return nil
+				}, WithReadSize(size))
+				assert.Ok(b, err)
+				reads += r.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkSignaturesConcurrency(b *testing.B) {
+	data := srand(260, 16*1024*1024)
+
+	for _, n := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				sigs, err := Signatures(context.Background(), bytes.NewReader(data), nil, WithConcurrency(n), WithChannelBuffer(64))
+				assert.Ok(b, err)
+				for s := range sigs {
+					assert.Ok(b, s.Error)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSyncApply(b *testing.B) {
+	ctx := context.Background()
+	cache := srand(2600, 1024*1024)
+	// Mostly literal data, with a few blocks found in the cache.
+	source := append(srand(2601, 16*1024*1024), cache...)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(b, err)
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(b, err)
+
+	for _, tt := range []struct {
+		desc string
+		opts []Option
+	}{
+		{"default", nil},
+		{"reuse", []Option{WithBufferReuse()}},
+		{"reuse+buffer", []Option{WithBufferReuse(), WithChannelBuffer(64)}},
+	} {
+		b.Run(tt.desc, func(b *testing.B) {
+			b.SetBytes(int64(len(source)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, tt.opts...)
+				assert.Ok(b, err)
+				assert.Ok(b, Apply(ctx, ioutil.Discard, bytes.NewReader(cache), ops))
+			}
+		})
+	}
+}
+
+func Benchmark6kbBlockSize(b *testing.B)    {}
+func Benchmark128kbBlockSize(b *testing.B)  {}
+func Benchmark512kbBlockSize(b *testing.B)  {}
+func Benchmark1024kbBlockSize(b *testing.B) {}
+
+func BenchmarkMD5(b *testing.B)     {}
+func BenchmarkSHA256(b *testing.B)  {}
+func BenchmarkSHA512(b *testing.B)  {}
+func BenchmarkMurmur3(b *testing.B) {}
+func BenchmarkXXHash(b *testing.B)  {}
+
+// TestWire tests that signatures and operations survive being encoded and decoded on their way between both ends.
+func TestWire(t *testing.T) {
+	ctx := context.Background()
+	basis := srand(252, 4*DefaultBlockSize+100)
+	source := append([]byte("prefix"), basis[DefaultBlockSize:]...)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(basis), md5.New(), WithBlockSize(MinBlockSize))
+	assert.Ok(t, err)
+
+	sigStream := new(bytes.Buffer)
+	assert.Ok(t, EncodeSignatures(ctx, sigStream, sigs))
+
+	decoded, err := DecodeSignatures(ctx, bytes.NewReader(sigStream.Bytes()))
+	assert.Ok(t, err)
+	remote, err := LookUpTable(ctx, decoded)
+	assert.Ok(t, err)
+	assert.Equals(t, MinBlockSize, tableBlockSize(remote))
+
+	ops, err := Sync(ctx, bytes.NewReader(source), md5.New(), remote)
+	assert.Ok(t, err)
+
+	opStream := new(bytes.Buffer)
+	assert.Ok(t, EncodeOperations(ctx, opStream, ops))
+	assert.Cond(t, opStream.Len() < len(source)/2, "encoded delta should be smaller than the source")
+
+	target := new(bytes.Buffer)
+	decodedOps, err := DecodeOperations(ctx, bytes.NewReader(opStream.Bytes()))
+	assert.Ok(t, err)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(basis), decodedOps, WithBlockSize(MinBlockSize)))
+	assert.Equals(t, source, target.Bytes())
+
+	decodedOps, err = DecodeOperations(ctx, bytes.NewReader(opStream.Bytes()[:opStream.Len()-1]))
+	assert.Ok(t, err)
+	err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(basis), decodedOps, WithBlockSize(MinBlockSize))
+	assert.Equals(t, ErrInvalidEncoding, errors.Cause(err))
+
+	decoded, err = DecodeSignatures(ctx, bytes.NewReader(opStream.Bytes()))
+	assert.Ok(t, err)
+	s := <-decoded
+	assert.Equals(t, ErrInvalidEncoding, errors.Cause(s.Error))
+
+	// Streams of version 1 lack records of version 2, and are refused as a whole.
+	old := append([]byte(nil), opStream.Bytes()...)
+	old[len(operationsMagic)] = 1
+	decodedOps, err = DecodeOperations(ctx, bytes.NewReader(old))
+	assert.Ok(t, err)
+	o := <-decodedOps
+	assert.Equals(t, ErrInvalidEncoding, errors.Cause(o.Error))
+}
+
+// TestSignatureReader tests that signatures read through SignatureReader decode back to the same signatures.
+func TestSignatureReader(t *testing.T) {
+	ctx := context.Background()
+	basis := srand(124, 4*DefaultBlockSize+100)
+
+	collect := func(sigs <-chan BlockSignature) []BlockSignature {
+		var all []BlockSignature
+		for s := range sigs {
+			all = append(all, s)
+		}
+		return all
+	}
+
+	sigs, err := Signatures(ctx, bytes.NewReader(basis), nil)
+	assert.Ok(t, err)
+	expected := collect(sigs)
+
+	sigs, err = Signatures(ctx, bytes.NewReader(basis), nil)
+	assert.Ok(t, err)
+	decoded, err := DecodeSignatures(ctx, SignatureReader(ctx, sigs))
+	assert.Ok(t, err)
+	assert.Equals(t, expected, collect(decoded))
+
+	// Nothing is read once the context is cancelled.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ioutil.ReadAll(SignatureReader(cctx, make(chan BlockSignature)))
+	assert.Equals(t, context.Canceled, errors.Cause(err))
+}
+
+// TestDeltaFiles tests the signature file, delta file and patching workflow.
+func TestDeltaFiles(t *testing.T) {
+	ctx := context.Background()
+	old := srand(253, 6*1024+500)
+	newer := append(append([]byte("new header"), old[:2*1024]...), old[3*1024:]...)
+
+	sig := new(bytes.Buffer)
+	assert.Ok(t, WriteSignature(ctx, bytes.NewReader(old), md5.New(), sig, WithBlockSize(1024)))
+
+	delta := new(bytes.Buffer)
+	assert.Ok(t, WriteDelta(ctx, bytes.NewReader(newer), md5.New(), bytes.NewReader(sig.Bytes()), delta))
+	assert.Cond(t, delta.Len() < len(newer)/2, "delta file should be smaller than the new file")
+
+	patched := new(bytes.Buffer)
+	assert.Ok(t, ApplyDelta(ctx, bytes.NewReader(old), bytes.NewReader(delta.Bytes()), patched))
+	assert.Equals(t, newer, patched.Bytes())
+
+	err := ApplyDelta(ctx, bytes.NewReader(old), bytes.NewReader(sig.Bytes()), new(bytes.Buffer))
+	assert.Equals(t, ErrInvalidEncoding, errors.Cause(err))
+
+	err = WriteDelta(ctx, bytes.NewReader(newer), md5.New(), bytes.NewReader(sig.Bytes()[:sig.Len()-1]), new(bytes.Buffer))
+	assert.Equals(t, ErrInvalidEncoding, errors.Cause(err))
+}
+
+// TestSyncArbitraryOffsets tests that blocks are matched wherever they moved to within the source, including the
+// shorter last block of the cache.
+func TestSyncArbitraryOffsets(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(254, 3*DefaultBlockSize+100)
+	last := cache[3*DefaultBlockSize:]
+
+	tests := []struct {
+		desc   string
+		source []byte
+		copies int
+	}{
+		{"byte inserted at the start", append([]byte("x"), cache...), 4},
+		{"bytes inserted before the last block", append(append(append([]byte(nil), cache[:3*DefaultBlockSize]...), "xy"...), last...), 4},
+		{"last block at the very end", append(append([]byte(nil), cache[100:2*DefaultBlockSize]...), last...), 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+			assert.Ok(t, err)
+			remote, err := LookUpTable(ctx, sigs)
+			assert.Ok(t, err)
+
+			ops, err := Sync(ctx, bytes.NewReader(tt.source), nil, remote)
+			assert.Ok(t, err)
+
+			var (
+				copies   int
+				literals []BlockOperation
+			)
+			target := new(bytes.Buffer)
+			assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), tee(ops, func(o BlockOperation) {
+				switch {
+				case len(o.Data) > 0:
+					literals = append(literals, o)
+				case !o.Final:
+					copies++
+				}
+			})))
+			assert.Equals(t, tt.source, target.Bytes())
+			assert.Equals(t, tt.copies, copies)
+
+			var sent int
+			for _, o := range literals {
+				sent += len(o.Data)
+			}
+			assert.Cond(t, sent < 2*DefaultBlockSize, "only data not found in the cache should be sent")
+		})
+	}
+}
+
+// tee calls fn with every operation from ops on its way out of the returned channel.
+func tee(ops <-chan BlockOperation, fn func(BlockOperation)) <-chan BlockOperation {
+	c := make(chan BlockOperation)
+	go func() {
+		defer close(c)
+		for o := range ops {
+			fn(o)
+			c <- o
+		}
+	}()
+	return c
+}
+
+// TestProgress tests that Sync and Apply report their statistics as they go, and once done.
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(256, 8*DefaultBlockSize)
+	source := append(append(append([]byte(nil), cache[:4*DefaultBlockSize]...), "inserted"...), cache[5*DefaultBlockSize:]...)
+
+	sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+	assert.Ok(t, err)
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(t, err)
+
+	var (
+		syncStats, applyStats Stats
+		reports               []Stats
+	)
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, WithProgress(func(s Stats) { syncStats = s }))
+	assert.Ok(t, err)
+
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops, WithStats(&applyStats), WithProgress(func(s Stats) {
+		reports = append(reports, s)
+	})))
+	assert.Equals(t, source, target.Bytes())
+
+	// The last report, the one sent when done, holds the same statistics as WithStats.
+	assert.Equals(t, applyStats, reports[len(reports)-1])
+	assert.Equals(t, int64(7), applyStats.MatchedBlocks)
+	assert.Equals(t, int64(len("inserted")), applyStats.LiteralBytes)
+	assert.Equals(t, int64(len(source)), applyStats.BytesWritten)
+	assert.Cond(t, applyStats.Elapsed > 0, "elapsed time should be reported")
+
+	assert.Equals(t, int64(7), syncStats.MatchedBlocks)
+	assert.Equals(t, int64(len("inserted")), syncStats.LiteralBytes)
+	assert.Equals(t, int64(len(source)), syncStats.BytesRead)
+}
+
+// TestHashKey tests that keyed checksums still match blocks at any offset, and that Apply verifies the checksum of
+// the reconstructed file.
+func TestHashKey(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(257, 6*DefaultBlockSize)
+	source := append(append(append([]byte(nil), cache[:2*DefaultBlockSize+7]...), "inserted"...), cache[2*DefaultBlockSize+7:]...)
+	key := WithHashKey([]byte("session key"))
+
+	signatures := func(opts ...Option) []BlockSignature {
+		var sigs []BlockSignature
+		assert.Ok(t, SignaturesFunc(ctx, bytes.NewReader(cache), nil, func(s BlockSignature) error {
+			sigs = append(sigs, s)
+			return nil
+		}, opts...))
+		return sigs
+	}
+	plain, keyed := signatures(), signatures(key)
+	assert.Cond(t, plain[0].Weak != keyed[0].Weak, "keyed weak checksums should differ")
+	assert.Cond(t, !bytes.Equal(plain[0].Strong, keyed[0].Strong), "keyed strong checksums should differ")
+
+	apply := func(cache []byte, opts ...Option) (Stats, error) {
+		sigs, err := Signatures(ctx, bytes.NewReader(cache), nil, key)
+		assert.Ok(t, err)
+		remote, err := LookUpTable(ctx, sigs)
+		assert.Ok(t, err)
+
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, key)
+		assert.Ok(t, err)
+		defer Drain(ops)
+
+		var stats Stats
+		target := new(bytes.Buffer)
+		err = Apply(ctx, target, bytes.NewReader(cache), ops, append(opts, WithStats(&stats))...)
+		if err == nil {
+			assert.Equals(t, source, target.Bytes())
+		}
+		return stats, err
+	}
+
+	stats, err := apply(cache, key)
+	assert.Ok(t, err)
+	assert.Equals(t, int64(5), stats.MatchedBlocks)
+
+	// Without the key, the checksum of the file cannot be verified.
+	_, err = apply(cache)
+	assert.Equals(t, ErrVerificationFailed, errors.Cause(err))
+
+	// Nor can it be if the cache changed since it was signed.
+	changed := append([]byte(nil), cache...)
+	sigs, err := Signatures(ctx, bytes.NewReader(changed), nil, key)
+	assert.Ok(t, err)
+	remote, err := LookUpTable(ctx, sigs)
+	assert.Ok(t, err)
+	ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, key)
+	assert.Ok(t, err)
+	changed[0] ^= 0xff
+	err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(changed), ops, key)
+	assert.Equals(t, ErrVerificationFailed, errors.Cause(err))
+}
+
+// memWriterAt is an in-memory io.WriterAt, keeping track of the lowest offset written to.
+type memWriterAt struct {
+	data   []byte
+	lowest int64
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	if off < m.lowest {
+		m.lowest = off
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *memWriterAt) Truncate(size int64) error {
+	m.data = m.data[:size]
+	return nil
+}
+
+// TestApplyAt tests that deltas are applied at their offsets, in place as well, however blocks moved around.
+func TestApplyAt(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(258, 4*DefaultBlockSize+100)
+	block := func(i int) []byte {
+		return cache[i*DefaultBlockSize : (i+1)*DefaultBlockSize]
+	}
+
+	tests := []struct {
+		desc   string
+		source []byte
+	}{
+		{"unchanged", cache},
+		{"shifted forward", append([]byte("prefix"), cache...)},
+		{"shifted backward", cache[10:]},
+		{"blocks swapped", bytes.Join([][]byte{block(1), block(0), block(3), block(2), cache[4*DefaultBlockSize:]}, nil)},
+		{"blocks repeated", bytes.Join([][]byte{block(2), block(2), block(0), []byte("literal"), block(2)}, nil)},
+		{"truncated", cache[:DefaultBlockSize+5]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sync := func() <-chan BlockOperation {
+				sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+				assert.Ok(t, err)
+				remote, err := LookUpTable(ctx, sigs)
+				assert.Ok(t, err)
+				ops, err := Sync(ctx, bytes.NewReader(tt.source), nil, remote)
+				assert.Ok(t, err)
+				return ops
+			}
+
+			dst := &memWriterAt{data: []byte("garbage left over to be truncated")}
+			assert.Ok(t, ApplyAt(ctx, dst, bytes.NewReader(cache), sync()))
+			assert.Equals(t, tt.source, dst.data)
+
+			f, err := ioutil.TempFile("", "gsync")
+			assert.Ok(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			_, err = f.Write(cache)
+			assert.Ok(t, err)
+			assert.Ok(t, ApplyAt(ctx, f, f, sync()))
+			data, err := ioutil.ReadFile(f.Name())
+			assert.Ok(t, err)
+			assert.Equals(t, tt.source, data)
+		})
+	}
+}
+
+// TestApplyAtShuffled tests that ApplyAt reconstructs files in place whatever the order their blocks are moved
+// in, so blocks copied are only written once no block left to copy reads what they overwrite. Files are
+// reconstructed concurrently, so the race detector catches state shared between calls.
+func TestApplyAtShuffled(t *testing.T) {
+	ctx := context.Background()
+	const blocks = 16
+	cache := srand(110, blocks*DefaultBlockSize+100)
+	block := func(i int) []byte {
+		return cache[i*DefaultBlockSize : (i+1)*DefaultBlockSize]
+	}
+
+	for i := 0; i < 8; i++ {
+		seed := int64(i)
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			t.Parallel()
+
+			// Blocks are shuffled, some repeated, some followed by literal data, and the file may shrink.
+			rnd := rand.New(rand.NewSource(seed))
+			var parts [][]byte
+			for _, j := range rnd.Perm(blocks) {
+				parts = append(parts, block(j))
+				switch rnd.Intn(4) {
+				case 0:
+					parts = append(parts, block(rnd.Intn(blocks)))
+				case 1:
+					parts = append(parts, srand(seed, rnd.Intn(100)+1))
+				}
+			}
+			if rnd.Intn(2) == 0 {
+				parts = parts[:len(parts)/2]
+			}
+			source := bytes.Join(parts, nil)
+
+			sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+			assert.Ok(t, err)
+			remote, err := LookUpTable(ctx, sigs)
+			assert.Ok(t, err)
+			ops, err := Sync(ctx, bytes.NewReader(source), nil, remote)
+			assert.Ok(t, err)
+
+			f, err := ioutil.TempFile("", "gsync")
+			assert.Ok(t, err)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			_, err = f.Write(cache)
+			assert.Ok(t, err)
+			assert.Ok(t, ApplyAt(ctx, f, f, ops))
+			data, err := ioutil.ReadFile(f.Name())
+			assert.Ok(t, err)
+			assert.Equals(t, source, data)
+		})
+	}
+}
+
+// TestResumeApplyAt tests that an interrupted ApplyAt continues from its last checkpoint.
+func TestResumeApplyAt(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(2581, 6*DefaultBlockSize)
+	source := append(append(append([]byte(nil), cache[:3*DefaultBlockSize]...), "inserted"...), cache[3*DefaultBlockSize:]...)
+
+	sync := func() <-chan BlockOperation {
+		sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		remote, err := LookUpTable(ctx, sigs)
+		assert.Ok(t, err)
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, remote)
+		assert.Ok(t, err)
+		return ops
+	}
+
+	checkpoints := new(bytes.Buffer)
+	dst := new(memWriterAt)
+	assert.Ok(t, ApplyAt(ctx, dst, bytes.NewReader(cache), sync(), WithCheckpoint(checkpoints, 2)))
+	assert.Equals(t, source, dst.data)
+
+	// Interrupted after the first checkpoint, in the middle of writing the second one.
+	index, offset, err := readCheckpoint(bytes.NewReader(checkpoints.Bytes()[:checkpointSize+3]))
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(2), index)
+	assert.Equals(t, int64(2*DefaultBlockSize), offset)
+
+	dst = &memWriterAt{data: append([]byte(nil), source[:offset]...), lowest: math.MaxInt64}
+	assert.Ok(t, ResumeApplyAt(ctx, dst, bytes.NewReader(cache), bytes.NewReader(checkpoints.Bytes()[:checkpointSize+3]), sync()))
+	assert.Equals(t, source, dst.data)
+	assert.Equals(t, offset, dst.lowest)
+
+	// Checkpoints of other deltas do not match.
+	var bogus bytes.Buffer
+	assert.Ok(t, writeCheckpointAt(&bogus, 2, 5))
+	err = ResumeApplyAt(ctx, new(memWriterAt), bytes.NewReader(cache), &bogus, sync())
+	assert.Equals(t, ErrInvalidDelta, errors.Cause(err))
+}
+
+// otherCompressor is a Compressor gzip compressing data under another ID.
+type otherCompressor struct {
+	Compressor
+}
+
+func (otherCompressor) ID() uint8 {
+	return 42
+}
+
+// TestCompression tests that literal data is compressed when it pays off, and decompressed by Apply.
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(259, 4*DefaultBlockSize)
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 3*DefaultBlockSize/43)
+	source := bytes.Join([][]byte{text, cache[:2*DefaultBlockSize], srand(2591, DefaultBlockSize)}, nil)
+
+	sync := func(opts ...Option) []BlockOperation {
+		sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		remote, err := LookUpTable(ctx, sigs)
+		assert.Ok(t, err)
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, opts...)
+		assert.Ok(t, err)
+
+		var delta []BlockOperation
+		for o := range ops {
+			delta = append(delta, o)
+		}
+		return delta
+	}
+	feed := func(delta []BlockOperation) <-chan BlockOperation {
+		ops := make(chan BlockOperation, len(delta))
+		for _, o := range delta {
+			ops <- o
+		}
+		close(ops)
+		return ops
+	}
+
+	delta := sync(WithCompression(GzipCompressor(gzip.BestSpeed)))
+	var compressed, raw, sent int
+	for _, o := range delta {
+		switch {
+		case len(o.Data) > 0 && o.Compression == GzipCompression:
+			compressed++
+		case len(o.Data) > 0:
+			raw++
+		}
+		sent += len(o.Data)
+	}
+	// The text spans several blocks but is sent in a single literal.
+	assert.Equals(t, 1, compressed)
+	assert.Equals(t, 1, raw)
+	assert.Cond(t, sent < 2*DefaultBlockSize, "text should compress")
+
+	assert.Ok(t, ValidateDelta(delta, 4))
+
+	// Gzip compressed data is decompressed without being asked to, also through the wire format.
+	stream := new(bytes.Buffer)
+	assert.Ok(t, EncodeOperations(ctx, stream, feed(delta)))
+	decoded, err := DecodeOperations(ctx, stream)
+	assert.Ok(t, err)
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), decoded))
+	assert.Equals(t, source, target.Bytes())
+
+	dst := new(memWriterAt)
+	assert.Ok(t, ApplyAt(ctx, dst, bytes.NewReader(cache), feed(delta)))
+	assert.Equals(t, source, dst.data)
+
+	// Other compressors have to be told.
+	other := otherCompressor{GzipCompressor(gzip.BestSpeed)}
+	delta = sync(WithCompression(other))
+	err = Apply(ctx, new(bytes.Buffer), bytes.NewReader(cache), feed(delta))
+	assert.Cond(t, err != nil, "unknown compression should fail")
+
+	target.Reset()
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), feed(delta), WithCompression(other)))
+	assert.Equals(t, source, target.Bytes())
+
+	// Compressed literals can't decompress to more than MaxBlockSize.
+	bomb, err := GzipCompressor(gzip.BestCompression).Compress(make([]byte, MaxBlockSize+1))
+	assert.Ok(t, err)
+	delta = []BlockOperation{{Data: bomb, Compression: GzipCompression}, {Final: true, TotalSize: MaxBlockSize + 1}}
+	err = Apply(ctx, new(bytes.Buffer), nil, feed(delta))
+	assert.Cond(t, err != nil, "oversized literal should fail")
+	assert.Equals(t, ErrInvalidDelta, errors.Cause(ValidateDelta(delta, 0)))
+}
+
+// TestConcurrency tests that signatures calculated across several workers are the same, and in the same order,
+// as when calculated one after the other.
+func TestConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		desc  string
+		size  int
+		shash func() hash.Hash
+		opts  []Option
+	}{
+		{"sha256", 20*DefaultBlockSize + 100, sha256.New, nil},
+		{"md5, whole blocks", 20 * DefaultBlockSize, md5.New, nil},
+		{"empty", 0, sha256.New, nil},
+		{"start index", 5*DefaultBlockSize + 1, sha256.New, []Option{WithStartIndex(3, 3*DefaultBlockSize)}},
+		{"salted", 7 * DefaultBlockSize, md5.New, []Option{WithIndexSalt()}},
+		{"not copyable", 7*DefaultBlockSize + 2, func() hash.Hash { return hmac.New(sha256.New, []byte("key")) }, nil},
+		{"limited memory", 9 * DefaultBlockSize, sha256.New, []Option{WithBufferAllocator(NewLimitedAllocator(DefaultReadSize + 2*DefaultBlockSize))}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			data := srand(2602, tt.size)
+
+			var expected []BlockSignature
+			expectedCheckpoints := new(bytes.Buffer)
+			opts := append(tt.opts, WithCheckpoint(expectedCheckpoints, 3))
+			assert.Ok(t, SignaturesFunc(ctx, bytes.NewReader(data), tt.shash(), func(s BlockSignature) error {
+				expected = append(expected, s)
+				return nil
+			}, opts...))
+
+			checkpoints := new(bytes.Buffer)
+			opts = append(tt.opts, WithCheckpoint(checkpoints, 3), WithConcurrency(4), WithChannelBuffer(2))
+			sigs, err := Signatures(ctx, bytes.NewReader(data), tt.shash(), opts...)
+			assert.Ok(t, err)
+
+			var actual []BlockSignature
+			for s := range sigs {
+				actual = append(actual, s)
+			}
+			assert.Equals(t, expected, actual)
+			assert.Equals(t, expectedCheckpoints.Bytes(), checkpoints.Bytes())
+		})
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err := SignaturesFunc(ctx, bytes.NewReader(srand(2603, 50*DefaultBlockSize)), nil, func(s BlockSignature) error {
+		n++
+		return stop
+	}, WithConcurrency(4))
+	assert.Equals(t, stop, err)
+	assert.Equals(t, 1, n)
+
+	// Reads failing midway are reported in order, and the scan goes on until cancelled.
+	ctx, cancel := context.WithCancel(ctx)
+	r := io.MultiReader(bytes.NewReader(srand(2604, 2*DefaultBlockSize)), failingReader{})
+	sigs, err := Signatures(ctx, r, nil, WithConcurrency(4))
+	assert.Ok(t, err)
+	s := <-sigs
+	assert.Ok(t, s.Error)
+	s = <-sigs
+	assert.Ok(t, s.Error)
+	s = <-sigs
+	assert.Equals(t, io.ErrClosedPipe, errors.Cause(s.Error))
+	assert.Equals(t, uint64(2), s.Index)
+	cancel()
+	for range sigs {
+	}
+}
+
+// failingReader fails every read.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// TestPooledBuffer tests that pooled buffers of nearby sizes share the pool of their size class.
+func TestPooledBuffer(t *testing.T) {
+	for _, n := range []int{1, 1000, 1023, 1024, 1025} {
+		b := pooledBuffer(n)
+		assert.Equals(t, n, len(*b))
+		assert.Equals(t, sizeClass(n), cap(*b))
+		releaseBuffer(b)
+	}
+	assert.Equals(t, 1024, sizeClass(1000))
+	assert.Equals(t, 1024, sizeClass(1024))
+	assert.Equals(t, 2048, sizeClass(1025))
+	assert.Cond(t, bufferPool(1000, false) == nil, "sizes other than size classes should not get pools")
+}
+
+// TestBufferReuse tests that operations sent in pooled buffers reconstruct the source like any others.
+func TestBufferReuse(t *testing.T) {
+	ctx := context.Background()
+	cache := srand(2605, 8*DefaultBlockSize)
+	source := bytes.Join([][]byte{srand(2606, 3*DefaultBlockSize+10), cache[2*DefaultBlockSize : 5*DefaultBlockSize], []byte("tail")}, nil)
+
+	sync := func(opts ...Option) <-chan BlockOperation {
+		sigs, err := Signatures(ctx, bytes.NewReader(cache), nil)
+		assert.Ok(t, err)
+		remote, err := LookUpTable(ctx, sigs)
+		assert.Ok(t, err)
+		ops, err := Sync(ctx, bytes.NewReader(source), nil, remote, opts...)
+		assert.Ok(t, err)
+		return ops
+	}
+
+	var expected []BlockOperation
+	for o := range sync() {
+		expected = append(expected, o)
+	}
+
+	var pooled int
+	ops := tee(sync(WithBufferReuse(), WithChannelBuffer(4)), func(o BlockOperation) {
+		if o.buf != nil {
+			pooled++
+		}
+	})
+	target := new(bytes.Buffer)
+	assert.Ok(t, Apply(ctx, target, bytes.NewReader(cache), ops))
+	assert.Equals(t, source, target.Bytes())
+	// Literals span several blocks, the ones before and after the copied blocks.
+	assert.Equals(t, 2, pooled)
+
+	// Ops not released keep their data.
+	var actual []BlockOperation
+	for o := range sync(WithBufferReuse()) {
+		o.buf = nil
+		actual = append(actual, o)
+	}
+	assert.Equals(t, expected, actual)
+}
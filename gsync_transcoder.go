@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Decoder returns a reader decoding the data read from r, a decompressor for instance.
+type Decoder func(r io.Reader) (io.Reader, error)
+
+// Encoder returns a writer encoding the data written to it into w, a compressor for instance.
+// Apply closes the returned writer once all blocks are written.
+type Encoder func(w io.Writer) (io.WriteCloser, error)
+
+// GzipDecoder is a Decoder for gzip streams.
+func GzipDecoder(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// GzipEncoder returns an Encoder producing gzip streams with the given compression level.
+func GzipEncoder(level int) Encoder {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	}
+}
+
+// decodedReaderAt provides random access to the decoded contents of r. Since decoders are usually
+// sequential, the whole content is decoded in memory the first time it is read.
+type decodedReaderAt struct {
+	r   io.ReaderAt
+	dec Decoder
+
+	once    sync.Once
+	decoded *bytes.Reader
+	err     error
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *decodedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	d.once.Do(func() {
+		dr, err := d.dec(io.NewSectionReader(d.r, 0, math.MaxInt64))
+		if err != nil {
+			d.err = errors.Wrapf(err, "failed decoding data")
+			return
+		}
+
+		data, err := ioutil.ReadAll(dr)
+		if err != nil {
+			d.err = errors.Wrapf(err, "failed decoding data")
+			return
+		}
+		d.decoded = bytes.NewReader(data)
+	})
+
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.decoded.ReadAt(p, off)
+}
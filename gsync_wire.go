@@ -0,0 +1,519 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Signatures and operations are encoded as streams of records, so they can be sent over a network connection as
+// they are produced, and decoded back into channels on the other end. Unsigned integers are encoded as varints
+// and the weak checksum as a big-endian uint32. A stream starts with a 4 bytes magic and a version byte:
+//
+//	signatures "GSSG", 2, block size, then one record per signature:
+//	           1, index, weak, strong checksum length, strong checksum
+//	           2, index, error message length, error message
+//	           0, marking the end of the stream
+//	operations "GSOP", 2, then one record per operation:
+//	           1, data length, data, for literals
+//	           2, index, for copies of basis blocks
+//	           3, dictionary version, index, for copies of dictionary blocks
+//	           5, error message length, error message
+//	           4, total size, for the final operation, which ends the stream
+//	           6, total size, checksum length, checksum, for final operations carrying a checksum
+//	           7, compression, data length, data, for compressed literals
+//
+// Version 2 added records 6 and 7. Decoders refuse streams of other versions, and unknown records as invalid.
+// They report streams ending before their end as truncated. Errors only travel as messages, their type is lost.
+const (
+	wireVersion      = 2
+	signaturesMagic  = "GSSG"
+	operationsMagic  = "GSOP"
+	maxWireStrongLen = 1024
+	maxWireDataLen   = 64 << 20 // 64mb
+)
+
+const (
+	wireEnd = iota
+	wireSignature
+	wireSignatureError
+)
+
+const (
+	_ = iota
+	wireLiteral
+	wireCopy
+	wireDictionaryCopy
+	wireFinal
+	wireOperationError
+	wireFinalChecksum
+	wireCompressedLiteral
+)
+
+// ErrInvalidEncoding is reported by DecodeSignatures and DecodeOperations when their input is not a valid stream.
+var ErrInvalidEncoding = errors.New("gsync: invalid encoding")
+
+// wireWriter buffers the records of a stream, flushing them whenever the channel they come from has nothing
+// ready, so the other end gets them as soon as possible without a write per record.
+type wireWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *wireWriter) uvarint(v uint64) {
+	w.write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+}
+
+func (w *wireWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *wireWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.write(b)
+}
+
+func (w *wireWriter) header(magic string) {
+	w.write([]byte(magic))
+	w.write([]byte{wireVersion})
+}
+
+func (w *wireWriter) signaturesHeader(size int) {
+	w.header(signaturesMagic)
+	w.uvarint(uint64(size))
+}
+
+// signature writes the record of s.
+func (w *wireWriter) signature(s BlockSignature) {
+	if s.Error != nil {
+		w.write([]byte{wireSignatureError})
+		w.uvarint(s.Index)
+		w.bytes([]byte(s.Error.Error()))
+		return
+	}
+
+	w.write([]byte{wireSignature})
+	w.uvarint(s.Index)
+	binary.BigEndian.PutUint32(w.buf[:4], s.Weak)
+	w.write(w.buf[:4])
+	w.bytes(s.Strong)
+}
+
+// operation writes the record of o.
+func (w *wireWriter) operation(o BlockOperation) {
+	switch {
+	case o.Error != nil:
+		w.write([]byte{wireOperationError})
+		w.bytes([]byte(o.Error.Error()))
+	case o.Final && len(o.Checksum) > 0:
+		w.write([]byte{wireFinalChecksum})
+		w.uvarint(uint64(o.TotalSize))
+		w.bytes(o.Checksum)
+	case o.Final:
+		w.write([]byte{wireFinal})
+		w.uvarint(uint64(o.TotalSize))
+	case len(o.Data) > 0 && o.Compression != 0:
+		w.write([]byte{wireCompressedLiteral, o.Compression})
+		w.bytes(o.Data)
+	case len(o.Data) > 0:
+		w.write([]byte{wireLiteral})
+		w.bytes(o.Data)
+	case o.Dictionary != 0:
+		w.write([]byte{wireDictionaryCopy})
+		w.uvarint(uint64(o.Dictionary))
+		w.uvarint(o.Index)
+	default:
+		w.write([]byte{wireCopy})
+		w.uvarint(o.Index)
+	}
+}
+
+func (w *wireWriter) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err != nil {
+		return errors.Wrapf(w.err, "failed writing stream")
+	}
+	return nil
+}
+
+// EncodeSignatures writes the signatures received from sigs to w, until sigs is closed, see DecodeSignatures.
+// All signatures must have the same block size.
+func EncodeSignatures(ctx context.Context, w io.Writer, sigs <-chan BlockSignature) error {
+	ww := &wireWriter{w: bufio.NewWriter(w)}
+
+	size := -1
+	for {
+		var (
+			s  BlockSignature
+			ok bool
+		)
+
+		select {
+		case s, ok = <-sigs:
+		default:
+			if err := ww.flush(); err != nil {
+				return err
+			}
+
+			select {
+			case s, ok = <-sigs:
+			case <-ctx.Done():
+				return errors.Wrapf(ctx.Err(), "failed encoding signatures")
+			}
+		}
+
+		// The header goes along with the first signature, which tells the block size.
+		if size < 0 {
+			size = s.BlockSize
+			ww.signaturesHeader(size)
+		}
+
+		if !ok {
+			ww.write([]byte{wireEnd})
+			return ww.flush()
+		}
+
+		if s.Error == nil && s.BlockSize != size {
+			return errors.Wrapf(ErrBlockSizeMismatch, "signature of block %d has blocks of %d bytes, others %d", s.Index, s.BlockSize, size)
+		}
+		ww.signature(s)
+	}
+}
+
+// SignatureReader returns a reader of the signatures received from sigs, encoded as by EncodeSignatures, for
+// piping them into a file or another process. Signatures are encoded as the reader is read, so reading slowly
+// holds back the signatures. Reading fails once the context is cancelled, or if encoding does.
+func SignatureReader(ctx context.Context, sigs <-chan BlockSignature) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		done := make(chan struct{})
+		defer close(done)
+
+		// Writes to the pipe block until read, cancellation unblocks them.
+		go func() {
+			select {
+			case <-ctx.Done():
+				pw.CloseWithError(errors.Wrapf(ctx.Err(), "failed encoding signatures"))
+			case <-done:
+			}
+		}()
+
+		pw.CloseWithError(EncodeSignatures(ctx, pw, sigs))
+	}()
+
+	return pr
+}
+
+// DecodeSignatures reads the signatures written by EncodeSignatures from r and pipes them out on the returned
+// channel, closing it when done reading or when the context is cancelled. Like Signatures, it does not block.
+// Problems reading r are reported by a last signature carrying the error.
+func DecodeSignatures(ctx context.Context, r io.Reader) (<-chan BlockSignature, error) {
+	if r == nil {
+		return nil, errors.New("gsync: reader required")
+	}
+
+	c := make(chan BlockSignature)
+
+	go func() {
+		defer close(c)
+
+		send := func(s BlockSignature) bool {
+			select {
+			case c <- s:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		err := decodeSignatures(bufio.NewReader(r), send)
+		if err != nil {
+			send(BlockSignature{Error: err})
+		}
+	}()
+
+	return c, nil
+}
+
+// decodeSignatures reads a stream of signatures from r, calling send with each of them until it returns false.
+func decodeSignatures(r *bufio.Reader, send func(BlockSignature) bool) error {
+	size, err := readSignaturesHeader(r)
+	if err != nil {
+		return err
+	}
+	return decodeSignatureRecords(r, size, send)
+}
+
+// readSignaturesHeader reads the header of a stream of signatures from r, returning its block size.
+func readSignaturesHeader(r *bufio.Reader) (int, error) {
+	if err := readHeader(r, signaturesMagic); err != nil {
+		return 0, err
+	}
+
+	size, err := readUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if size > maxWireDataLen {
+		return 0, errors.Wrapf(ErrInvalidEncoding, "invalid block size %d", size)
+	}
+	return int(size), nil
+}
+
+// decodeSignatureRecords reads the records following the header of a stream of signatures of blocks of size
+// bytes, calling send with each of them until it returns false.
+func decodeSignatureRecords(r *bufio.Reader, size int, send func(BlockSignature) bool) error {
+	var weak [4]byte
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+
+		var s BlockSignature
+		switch tag {
+		case wireEnd:
+			return nil
+		case wireSignature:
+			if s.Index, err = readUvarint(r); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(r, weak[:]); err != nil {
+				return truncated(err)
+			}
+			s.Weak = binary.BigEndian.Uint32(weak[:])
+			if s.Strong, err = readBytes(r, maxWireStrongLen); err != nil {
+				return err
+			}
+			s.BlockSize = size
+		case wireSignatureError:
+			if s.Index, err = readUvarint(r); err != nil {
+				return err
+			}
+			msg, err := readBytes(r, maxWireDataLen)
+			if err != nil {
+				return err
+			}
+			s.Error = errors.New(string(msg))
+		default:
+			return errors.Wrapf(ErrInvalidEncoding, "unknown signature record %d", tag)
+		}
+
+		if !send(s) {
+			return nil
+		}
+	}
+}
+
+// EncodeOperations writes the operations received from ops to w, until the final one or until ops is closed,
+// see DecodeOperations.
+func EncodeOperations(ctx context.Context, w io.Writer, ops <-chan BlockOperation) error {
+	ww := &wireWriter{w: bufio.NewWriter(w)}
+	ww.header(operationsMagic)
+
+	for {
+		var (
+			o  BlockOperation
+			ok bool
+		)
+
+		select {
+		case o, ok = <-ops:
+		default:
+			if err := ww.flush(); err != nil {
+				return err
+			}
+
+			select {
+			case o, ok = <-ops:
+			case <-ctx.Done():
+				return errors.Wrapf(ctx.Err(), "failed encoding operations")
+			}
+		}
+
+		// Streams without final operation are left truncated, for the other end to notice.
+		if !ok {
+			return ww.flush()
+		}
+
+		ww.operation(o)
+		if o.Final {
+			return ww.flush()
+		}
+	}
+}
+
+// DecodeOperations reads the operations written by EncodeOperations from r and pipes them out on the returned
+// channel, ready for Apply, closing it after the final operation or when the context is cancelled. Like Sync,
+// it does not block. Problems reading r are reported by a last operation carrying the error.
+func DecodeOperations(ctx context.Context, r io.Reader) (<-chan BlockOperation, error) {
+	if r == nil {
+		return nil, errors.New("gsync: reader required")
+	}
+
+	o := make(chan BlockOperation)
+
+	go func() {
+		defer close(o)
+
+		send := func(op BlockOperation) bool {
+			select {
+			case o <- op:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		err := decodeOperations(bufio.NewReader(r), send)
+		if err != nil {
+			send(BlockOperation{Error: err})
+		}
+	}()
+
+	return o, nil
+}
+
+// decodeOperations reads a stream of operations from r, calling send with each of them until it returns false.
+func decodeOperations(r *bufio.Reader, send func(BlockOperation) bool) error {
+	if err := readHeader(r, operationsMagic); err != nil {
+		return err
+	}
+
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+
+		var o BlockOperation
+		switch tag {
+		case wireLiteral:
+			if o.Data, err = readBytes(r, maxWireDataLen); err != nil {
+				return err
+			}
+			if len(o.Data) == 0 {
+				return errors.Wrapf(ErrInvalidEncoding, "empty literal")
+			}
+		case wireCompressedLiteral:
+			if o.Compression, err = r.ReadByte(); err != nil {
+				return truncated(err)
+			}
+			if o.Compression == 0 {
+				return errors.Wrapf(ErrInvalidEncoding, "invalid compression %d", o.Compression)
+			}
+			if o.Data, err = readBytes(r, maxWireDataLen); err != nil {
+				return err
+			}
+			if len(o.Data) == 0 {
+				return errors.Wrapf(ErrInvalidEncoding, "empty literal")
+			}
+		case wireCopy:
+			if o.Index, err = readUvarint(r); err != nil {
+				return err
+			}
+		case wireDictionaryCopy:
+			version, err := readUvarint(r)
+			if err != nil {
+				return err
+			}
+			if version == 0 || version > uint64(^uint32(0)) {
+				return errors.Wrapf(ErrInvalidEncoding, "invalid dictionary version %d", version)
+			}
+			o.Dictionary = uint32(version)
+			if o.Index, err = readUvarint(r); err != nil {
+				return err
+			}
+		case wireOperationError:
+			msg, err := readBytes(r, maxWireDataLen)
+			if err != nil {
+				return err
+			}
+			o.Error = errors.New(string(msg))
+		case wireFinal, wireFinalChecksum:
+			size, err := readUvarint(r)
+			if err != nil {
+				return err
+			}
+
+			final := BlockOperation{Final: true, TotalSize: int64(size)}
+			if tag == wireFinalChecksum {
+				if final.Checksum, err = readBytes(r, maxWireStrongLen); err != nil {
+					return err
+				}
+			}
+			send(final)
+			return nil
+		default:
+			return errors.Wrapf(ErrInvalidEncoding, "unknown operation record %d", tag)
+		}
+
+		if !send(o) {
+			return nil
+		}
+	}
+}
+
+// readHeader checks the stream in r starts with magic, and has a version this package understands.
+func readHeader(r *bufio.Reader, magic string) error {
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return truncated(err)
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return errors.Wrapf(ErrInvalidEncoding, "unexpected stream header")
+	}
+
+	if v := header[len(magic)]; v != wireVersion {
+		return errors.Wrapf(ErrInvalidEncoding, "unsupported version %d", v)
+	}
+	return nil
+}
+
+func readUvarint(r *bufio.Reader) (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, truncated(err)
+	}
+	return v, nil
+}
+
+// readBytes reads a length-prefixed byte slice from r, refusing lengths over max.
+func readBytes(r *bufio.Reader, max uint64) ([]byte, error) {
+	n, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > max {
+		return nil, errors.Wrapf(ErrInvalidEncoding, "record of %d bytes exceeds the limit of %d", n, max)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, truncated(err)
+	}
+	return b, nil
+}
+
+// truncated reports streams ending midway as such.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Wrapf(ErrInvalidEncoding, "truncated stream")
+	}
+	return errors.Wrapf(err, "failed reading stream")
+}